@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,8 +18,13 @@ import (
 type Config struct {
 	SubAddresses            string `desc:"sub addresses" def:""`                                                                             //这个信息会帮助你生成V2ray/Clash/ShadowRocket的订阅链接,同时这个是互联网浏览器访问的地址
 	AppPort                 string `desc:"app port" def:"80"`                                                                                //golang app 服务端口,可选,建议默认80或者443
-	RegisterUrl             string `desc:"register url" def:"https://unchainapi.bob99.workers.dev/api/node"`                                 //optional,流量,用户鉴权的主控服务器地址
+	Mode                    string `desc:"standalone or managed" def:""`                                                                     //standalone: 只使用本地用户(AllowUsers/管理API),不连接任何主控服务器; managed: 由主控服务器管理用户和流量,启动时主控服务器不可用且没有用户缓存则退出; 为空时按RegisterUrl是否为空推断
+	RegisterUrl             string `desc:"register url" def:""`                                                                              //managed模式下流量,用户鉴权的主控服务器地址,多个地址用逗号分隔,按顺序故障切换
 	RegisterToken           string `desc:"register token" def:"unchain people from censorship and surveillance"`                             //optional,流量,用户鉴权的主控服务器token
+	ManagerAuth             string `desc:"manager auth hmac or token" def:"hmac"`                                                            //hmac(默认): 用RegisterToken做HMAC签名请求并校验主控服务器响应签名; token: 明文发送RegisterToken且不校验响应,只允许https主控地址
+	ConfigUrl               string `desc:"node config url" def:""`                                                                           //optional,从主控服务器拉取节点配置(用户限额,订阅地址,日志级别,推送间隔)的地址,多个地址用逗号分隔,为空则不拉取
+	ConfigPollSecond        string `desc:"node config poll second" def:"60"`                                                                 //seconds 拉取节点配置的间隔时间
+	StreamUrl               string `desc:"manager event stream url" def:""`                                                                  //optional,主控服务器的SSE实时用户变更推送地址,多个地址用逗号分隔,为空则只使用定时推送
 	AllowUsers              string `desc:"allow users UUID" def:"903bcd04-79e7-429c-bf0c-0456c7de9cdc,903bcd04-79e7-429c-bf0c-0456c7de9cd1"` //单机模式下,允许的用户UUID
 	LogFile                 string `desc:"log file path" def:""`                                                                             //日志文件路径
 	DebugLevel              string `desc:"debug level" def:"DEBUG"`                                                                          //日志级别
@@ -28,12 +34,37 @@ type Config struct {
 	RunAt                   string `desc:"run at" def:""`                                                                                    //optional run at
 	EnableDataUsageMetering string `desc:"enable data usage metering" def:"true"`                                                            //是否开启用户流量统计,使用true 开启用户流量统计,使用false 关闭用户流量统计
 	BufferSize              string `desc:"buffer size in bytes" def:"8192"`                                                                  //缓冲区大小,用于WebSocket和TCP/UDP读取
+	AdminToken              string `desc:"admin api bearer token" def:""`                                                                    //管理API的Bearer token,为空则关闭管理API
+	AdminListen             string `desc:"admin api listen address" def:""`                                                                  //管理API单独的监听地址,例如 127.0.0.1:8014,为空则挂载在 /admin/ 路径下
+	StateFile               string `desc:"traffic state file" def:"unchain.state.json"`                                                      //未上报流量的本地存档文件,重启或崩溃后恢复,为空则不保存
+	CheckpointSecond        string `desc:"checkpoint interval second" def:"60"`                                                              //seconds 流量存档的间隔时间
+	SpoolDir                string `desc:"unacknowledged report spool dir" def:"unchain.spool"`                                              //未被主控服务器确认的流量报告目录,失败后重试,为空则只保存在内存
+	HistoryFile             string `desc:"usage history file" def:"unchain.history.json"`                                                    //用户按小时/天的流量历史记录文件,为空则不记录
+	UserCacheFile           string `desc:"last known good user cache file" def:"unchain.users.json"`                                         //主控服务器最后一次下发的用户列表缓存,主控服务器不可用时重启节点仍然允许这些用户,为空则不缓存
+	WebhookUrls             string `desc:"event webhook urls" def:""`                                                                        //事件webhook地址(会话开始/结束,超出流量,无效UUID),多个地址用逗号分隔,为空则关闭
+	WebhookSecret           string `desc:"event webhook hmac secret" def:""`                                                                 //webhook的HMAC签名密钥,为空则不签名
+	WebhookBatchSize        string `desc:"event webhook batch size" def:"100"`                                                               //每次发送的最多事件数
+	WebhookFlushSecond      string `desc:"event webhook flush second" def:"5"`                                                               //seconds 事件最多缓存多久再发送
+	AuthFailLimit           string `desc:"invalid uuid per ip per minute" def:"5"`                                                           //同一IP每分钟无效UUID达到次数后发送auth.invalid_uuid事件
+	TrustedProxies          string `desc:"trusted reverse proxy cidrs" def:""`                                                               //信任的反向代理网段(CDN,nginx),只有来自这些地址的请求才使用CF-Connecting-IP/X-Real-IP/X-Forwarded-For作为客户端IP,多个用逗号分隔
+	TLSCert                 string `desc:"tls certificate file" def:""`                                                                      //可选,TLS证书文件,和TLSKey一起设置后直接提供HTTPS/WSS,SIGHUP时重新加载
+	TLSKey                  string `desc:"tls key file" def:""`                                                                              //可选,TLS私钥文件
+	DstAllowCidrs           string `desc:"allowed destination cidrs" def:""`                                                                 //允许访问的目标网段,可以放行默认禁止的内网网段,多个用逗号分隔,例如 10.0.5.0/24
+	DstDenyCidrs            string `desc:"denied destination cidrs" def:""`                                                                  //额外禁止访问的目标网段,多个用逗号分隔.内网,回环,链路本地,组播和云元数据网段默认禁止
+	DstAllowPorts           string `desc:"allowed destination ports" def:""`                                                                 //只允许访问的目标端口,例如 80,443,8000-9000,为空则不限制
+	DstDenyPorts            string `desc:"denied destination ports" def:""`                                                                  //禁止访问的目标端口,例如 25,445
+	RoutingFile             string `desc:"routing rules file" def:""`                                                                        //路由规则文件(toml),按目标域名/IP/端口/用户/协议选择出口(direct,block或自定义出口),为空则全部直连,SIGHUP时重新加载
+	ReportDetections        string `desc:"report protocol detections to the manager" def:"false"`                                            //true时在流量报告中附带BitTorrent/SMTP等协议的识别次数(按用户),供主控服务器统计
 }
 
 func (c Config) EnableUsageMetering() bool {
 	return strings.ToLower(c.EnableDataUsageMetering) == "true"
 }
 
+func (c Config) ReportProtocolDetections() bool {
+	return strings.ToLower(c.ReportDetections) == "true"
+}
+
 func (c Config) SubHostWithPort() []string {
 	parts := strings.Split(c.SubAddresses, ",")
 	ids := make([]string, 0)
@@ -130,7 +161,10 @@ var (
 	buildTime string
 )
 
-var cfg *Config
+var (
+	cfg        *Config
+	cfgFromEnv bool
+)
 
 // Cfg load config from toml file or env
 func Cfg(tomlFilePath string) *Config {
@@ -142,6 +176,7 @@ func Cfg(tomlFilePath string) *Config {
 		fmt.Println(tomlFilePath, err)
 		fmt.Println("unable to load config file form config.toml file, use env instead")
 		cfg = loadEnv()
+		cfgFromEnv = true
 	} else {
 		cfg = cfgIns
 	}
@@ -151,6 +186,31 @@ func Cfg(tomlFilePath string) *Config {
 	return cfg
 }
 
+// Reload reads the config again from where Cfg loaded it and replaces the singleton,
+// on error the current config is kept. The returned config is new, the old one is left unchanged.
+func Reload(tomlFilePath string) (*Config, error) {
+	var next *Config
+	if cfgFromEnv {
+		next = loadEnv()
+	} else {
+		c, err := loadFromToml(tomlFilePath)
+		if err != nil {
+			return nil, err
+		}
+		next = c
+	}
+	if err := next.ValidateMode(); err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		next.RunAt = cfg.RunAt
+	}
+	next.GitHash = gitHash
+	next.BuildTime = buildTime
+	cfg = next
+	return next, nil
+}
+
 func loadFromToml(file string) (*Config, error) {
 	opt := Config{}
 	_, err := toml.DecodeFile(file, &opt)
@@ -188,6 +248,167 @@ func (c Config) UserIDS() []string {
 	return ids
 }
 
+const (
+	ModeStandalone = "standalone"
+	ModeManaged    = "managed"
+)
+
+// RunMode returns the Mode, an empty Mode is derived from RegisterUrl for older config files.
+func (c Config) RunMode() string {
+	mode := strings.ToLower(strings.TrimSpace(c.Mode))
+	if mode != "" {
+		return mode
+	}
+	if strings.TrimSpace(c.RegisterUrl) == "" {
+		return ModeStandalone
+	}
+	return ModeManaged
+}
+
+// Managed reports whether the node is run by a manager, a standalone node makes no manager calls.
+func (c Config) Managed() bool {
+	return c.RunMode() == ModeManaged
+}
+
+func (c Config) ValidateMode() error {
+	switch c.RunMode() {
+	case ModeStandalone:
+		return nil
+	case ModeManaged:
+		if len(c.RegisterUrls()) == 0 {
+			return fmt.Errorf("Mode = %s needs a RegisterUrl", ModeManaged)
+		}
+		return c.validateManagerAuth()
+	default:
+		return fmt.Errorf("unknown Mode %q, use %s or %s", c.Mode, ModeStandalone, ModeManaged)
+	}
+}
+
+// DefaultRegisterToken is the RegisterToken default, it is public and authenticates nothing.
+const DefaultRegisterToken = "unchain people from censorship and surveillance"
+
+// PublicRegisterToken reports whether the token is empty or the public default.
+func PublicRegisterToken(token string) bool {
+	token = strings.TrimSpace(token)
+	return token == "" || token == DefaultRegisterToken
+}
+
+// validateManagerAuth refuses the settings that let anyone on the path to the manager hand out users:
+// a public RegisterToken, or unverified responses over plain http.
+func (c Config) validateManagerAuth() error {
+	if PublicRegisterToken(c.RegisterToken) {
+		return fmt.Errorf("Mode = %s needs a RegisterToken of its own, the default one is public", ModeManaged)
+	}
+	switch strings.ToLower(strings.TrimSpace(c.ManagerAuth)) {
+	case "", "hmac":
+		return nil
+	case "token":
+		for _, u := range slices.Concat(c.RegisterUrls(), c.ConfigUrls(), c.StreamUrls()) {
+			if !strings.HasPrefix(strings.ToLower(u), "https://") {
+				return fmt.Errorf("ManagerAuth = token does not verify the manager responses, it needs https manager urls: %s", u)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown ManagerAuth %q, use hmac or token", c.ManagerAuth)
+	}
+}
+
+func splitList(s string) []string {
+	res := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// RegisterUrls returns the manager report endpoints in failover order.
+func (c Config) RegisterUrls() []string {
+	return splitList(c.RegisterUrl)
+}
+
+func (c Config) ConfigUrls() []string {
+	return splitList(c.ConfigUrl)
+}
+
+func (c Config) StreamUrls() []string {
+	return splitList(c.StreamUrl)
+}
+
+func (c Config) WebhookTargets() []string {
+	return splitList(c.WebhookUrls)
+}
+
+func (c Config) WebhookBatch() int {
+	iv, err := strconv.Atoi(c.WebhookBatchSize)
+	if err != nil || iv <= 0 {
+		return 100
+	}
+	return iv
+}
+
+func (c Config) WebhookFlushInterval() time.Duration {
+	iv, err := strconv.ParseInt(c.WebhookFlushSecond, 10, 32)
+	if err != nil || iv <= 0 {
+		return 5 * time.Second
+	}
+	return time.Second * time.Duration(iv)
+}
+
+func (c Config) AuthFailThreshold() int {
+	iv, err := strconv.Atoi(c.AuthFailLimit)
+	if err != nil || iv <= 0 {
+		return 5
+	}
+	return iv
+}
+
+func (c Config) TrustedProxyList() []string {
+	return splitList(c.TrustedProxies)
+}
+
+func (c Config) DstAllowCidrList() []string {
+	return splitList(c.DstAllowCidrs)
+}
+
+func (c Config) DstDenyCidrList() []string {
+	return splitList(c.DstDenyCidrs)
+}
+
+// TLSEnabled reports whether the app port serves TLS itself instead of behind a reverse proxy.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// ManagerSigned reports whether the manager requests are HMAC signed and the responses verified,
+// everything but ManagerAuth = token is.
+func (c Config) ManagerSigned() bool {
+	return strings.ToLower(strings.TrimSpace(c.ManagerAuth)) != "token"
+}
+
+// AdminEnabled reports whether the admin REST API should be served.
+func (c Config) AdminEnabled() bool {
+	return c.AdminToken != ""
+}
+
+func (c Config) CheckpointInterval() time.Duration {
+	iv, err := strconv.ParseInt(c.CheckpointSecond, 10, 32)
+	if err != nil || iv <= 0 {
+		return time.Minute
+	}
+	return time.Second * time.Duration(iv)
+}
+
+func (c Config) ConfigPollInterval() time.Duration {
+	iv, err := strconv.ParseInt(c.ConfigPollSecond, 10, 32)
+	if err != nil || iv <= 0 {
+		return time.Minute
+	}
+	return time.Second * time.Duration(iv)
+}
+
 func (c Config) PushInterval() time.Duration {
 	if c.PushIntervalSecond() <= 0 {
 		return time.Minute * 60
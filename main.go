@@ -4,14 +4,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/unchainese/unchain/global"
+	"github.com/unchainese/unchain/manager"
 	"github.com/unchainese/unchain/server"
 )
 
@@ -38,6 +41,8 @@ func main() {
 		installService()
 	case "client":
 		runClient()
+	case "manager":
+		runManager(args[1:])
 	case "help", "-h", "--help":
 		printHelp()
 	default:
@@ -49,6 +54,10 @@ func main() {
 
 func runServer() {
 	c := global.Cfg(configFilePath) //using default config.toml file
+	if err := c.ValidateMode(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	fd := global.SetupLogger(c)
 	defer fd.Close()
 
@@ -57,15 +66,33 @@ func runServer() {
 	signal.Notify(stop, os.Interrupt)
 
 	app := server.NewApp(c, stop)
-	app.PushNode()                 //register node info to the manager server
+	if err := app.Connect(); err != nil { //register node info to the manager server
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	app.PrintVLESSConnectionURLS() //for standalone node
 	go app.Run()
+	go reloadOnHangup(app)
 	<-stop
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	app.Shutdown(ctx)
 }
 
+// reloadOnHangup re-reads the config file on SIGHUP and applies it without dropping the tunnels.
+func reloadOnHangup(app *server.App) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := global.Reload(configFilePath)
+		if err != nil {
+			log.Println("Error reloading config, the current one is kept:", err)
+			continue
+		}
+		app.Reload(c)
+	}
+}
+
 func installService() {
 	// Check if systemctl is available
 	cmd := exec.Command("systemctl", "--version")
@@ -134,6 +161,45 @@ func runClient() {
 	server.StartSocks5Server()
 }
 
+func runManager(args []string) {
+	c, err := manager.LoadConfig(configFilePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(args) > 0 && args[0] != "serve" {
+		if err := manager.RunCLI(c, args); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := c.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	store, err := manager.OpenStore(c.ManagerDB)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+
+	m := manager.New(c, store)
+	go func() {
+		if err := m.Run(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+	<-stop
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m.Shutdown(ctx)
+}
+
 func printHelp() {
 	fmt.Println("Unchain - A VLESS over WebSocket proxy server")
 	fmt.Println()
@@ -144,6 +210,7 @@ func printHelp() {
 	fmt.Println("  run       Run the server (default)")
 	fmt.Println("  install   Install the service")
 	fmt.Println("  client    Run as SOCKS5 server as VPN client")
+	fmt.Println("  manager   Run the bundled manager server, or manage its users (manager user ...)")
 	fmt.Println("  help      Show this help message")
 	fmt.Println()
 	fmt.Println("Flags:")
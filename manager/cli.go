@@ -0,0 +1,208 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client talks to the admin API of a running manager.
+type Client struct {
+	cfg     *Config
+	baseURL string
+	http    *http.Client
+}
+
+func NewClient(c *Config, baseURL string) *Client {
+	if baseURL == "" {
+		host, port, err := net.SplitHostPort(c.ManagerListen)
+		if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		baseURL = "http://" + net.JoinHostPort(host, port)
+	}
+	return &Client{cfg: c, baseURL: strings.TrimSuffix(baseURL, "/"), http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Do sends a request to the manager and decodes the JSON response into out.
+func (c *Client) Do(method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = raw
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.cfg.ManagerAdminToken)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+const cliUsage = `Usage:
+  unchain manager [serve]                                   Run the manager server
+  unchain manager user list                                 List users
+  unchain manager user add [-quota KB] [-sessions N] [-note TEXT] [UUID]
+                                                            Add a user, a random UUID is used if omitted
+  unchain manager user rm UUID                              Remove a user
+  unchain manager user enable|disable UUID                  Enable or disable a user
+  unchain manager user quota UUID KB                        Set the quota, 0 means unlimited
+  unchain manager user reset UUID                           Reset the used traffic
+  unchain manager nodes                                     List nodes
+
+Flags:
+  -server URL   manager base URL, default http://<ManagerListen>
+`
+
+// RunCLI runs the user management commands, args start after "manager".
+func RunCLI(c *Config, args []string) error {
+	fs := flag.NewFlagSet("manager", flag.ContinueOnError)
+	server := fs.String("server", "", "manager base URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	client := NewClient(c, *server)
+	if len(args) == 0 {
+		fmt.Print(cliUsage)
+		return errors.New("missing command")
+	}
+	switch args[0] {
+	case "nodes":
+		nodes := make([]Node, 0)
+		if err := client.Do(http.MethodGet, "/api/admin/nodes", nil, &nodes); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOSTNAME\tLAST SEEN\tTRAFFIC KB\tSESSIONS\tCPU\tDOWN KB/S\tSUB ADDRESSES\tVERSION")
+		for _, n := range nodes {
+			sessions, cpu, down := "-", "-", "-"
+			if n.Load != nil {
+				sessions = fmt.Sprint(n.Load.Sessions)
+				cpu = fmt.Sprintf("%.1f%%", n.Load.CPUPercent)
+				down = fmt.Sprint(n.Load.DownBps >> 10)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", n.Hostname, n.LastSeen.Format(time.DateTime), n.TrafficKb, sessions, cpu, down, strings.Join(n.SubAddresses, ","), n.VersionInfo)
+		}
+		return tw.Flush()
+	case "user":
+		return runUserCLI(client, args[1:])
+	default:
+		fmt.Print(cliUsage)
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+func printUsers(users ...User) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UUID\tENABLED\tQUOTA KB\tUSED KB\tMAX SESSIONS\tNOTE")
+	for _, u := range users {
+		quota := "unlimited"
+		if u.QuotaKb > 0 {
+			quota = fmt.Sprint(u.QuotaKb)
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%d\t%d\t%s\n", u.UID, !u.Disabled, quota, u.UsedKb, u.MaxSessions, u.Note)
+	}
+	return tw.Flush()
+}
+
+func runUserCLI(client *Client, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(cliUsage)
+		return errors.New("missing user command")
+	}
+	cmd, args := args[0], args[1:]
+	if cmd == "list" {
+		users := make([]User, 0)
+		if err := client.Do(http.MethodGet, "/api/admin/users", nil, &users); err != nil {
+			return err
+		}
+		return printUsers(users...)
+	}
+	if cmd == "add" {
+		fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+		quota := fs.Int64("quota", 0, "quota in KB, 0 means unlimited")
+		sessions := fs.Int64("sessions", 0, "max sessions per node, 0 means unlimited")
+		note := fs.String("note", "", "note")
+		ob := fs.String("outbound", "", "routing outbound of the user on the nodes")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		uid := uuid.NewString()
+		if fs.NArg() > 0 {
+			uid = fs.Arg(0)
+		}
+		u := User{}
+		args := UserArgs{UID: uid, QuotaKb: quota, MaxSessions: sessions, Note: note, Outbound: ob}
+		if err := client.Do(http.MethodPost, "/api/admin/users", args, &u); err != nil {
+			return err
+		}
+		return printUsers(u)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("user %s: missing UUID", cmd)
+	}
+	uid := args[0]
+	u := User{}
+	var err error
+	switch cmd {
+	case "rm", "remove":
+		err = client.Do(http.MethodDelete, "/api/admin/users/"+uid, nil, nil)
+		if err == nil {
+			fmt.Println("removed", uid)
+		}
+		return err
+	case "enable", "disable":
+		disabled := cmd == "disable"
+		err = client.Do(http.MethodPatch, "/api/admin/users/"+uid, UserArgs{Disabled: &disabled}, &u)
+	case "quota":
+		if len(args) < 2 {
+			return errors.New("user quota: missing KB")
+		}
+		kb := int64(0)
+		if _, err := fmt.Sscan(args[1], &kb); err != nil {
+			return fmt.Errorf("user quota: %w", err)
+		}
+		err = client.Do(http.MethodPatch, "/api/admin/users/"+uid, UserArgs{QuotaKb: &kb}, &u)
+	case "reset":
+		err = client.Do(http.MethodPost, "/api/admin/users/"+uid+"/reset", nil, &u)
+	default:
+		fmt.Print(cliUsage)
+		return fmt.Errorf("unknown user command: %s", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return printUsers(u)
+}
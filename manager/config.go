@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/unchainese/unchain/global"
+)
+
+// Config is the config of the manager subcommand, read from its own file, the node settings are not in it.
+type Config struct {
+	ManagerListen      string //监听地址,节点的RegisterUrl填 http://<地址>/api/node
+	ManagerDB          string //用户/节点数据库文件
+	RegisterToken      string //和节点共用的token,不能为空或默认值
+	ManagerAuth        string //hmac(默认)或token,和节点一致
+	ManagerRoutingFile string //下发给节点的路由规则文件(toml,格式同节点的RoutingFile),为空则不下发
+	ManagerAdminToken  string //管理API(/api/admin/*和user/nodes命令)的Bearer token,和RegisterToken分开,为空则关闭管理API
+}
+
+// LoadConfig reads the manager config file, keys of a node config in the same file are ignored.
+func LoadConfig(file string) (*Config, error) {
+	c := &Config{}
+	if _, err := toml.DecodeFile(file, c); err != nil {
+		return nil, fmt.Errorf("failed to load manager config file:%s %w", file, err)
+	}
+	if c.ManagerListen == "" {
+		c.ManagerListen = "127.0.0.1:8015"
+	}
+	if c.ManagerDB == "" {
+		c.ManagerDB = "unchain.manager.json"
+	}
+	return c, nil
+}
+
+// Validate refuses to serve the nodes with a public RegisterToken or an unknown ManagerAuth.
+func (c *Config) Validate() error {
+	if global.PublicRegisterToken(c.RegisterToken) {
+		return fmt.Errorf("the manager needs a RegisterToken of its own, the default one is public")
+	}
+	switch strings.ToLower(strings.TrimSpace(c.ManagerAuth)) {
+	case "", "hmac", "token":
+		return nil
+	default:
+		return fmt.Errorf("unknown ManagerAuth %q, use hmac or token", c.ManagerAuth)
+	}
+}
+
+// Signed reports whether the node requests must be HMAC signed and the responses are signed,
+// everything but ManagerAuth = token is, the same as on the nodes.
+func (c *Config) Signed() bool {
+	return strings.ToLower(strings.TrimSpace(c.ManagerAuth)) != "token"
+}
@@ -0,0 +1,455 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+const (
+	maxBody      = 16 << 20
+	pingInterval = 30 * time.Second
+)
+
+type event struct {
+	name string
+	data []byte
+}
+
+// Manager is the reference control plane for unchain nodes.
+//
+//	POST   /api/node                    node report (schema.AppStat), answers the allowed users
+//	GET    /api/node/config             node config (schema.NodeConfig), supports If-None-Match
+//	GET    /api/node/stream             server-sent user changes
+//	GET    /api/admin/users             list users
+//	POST   /api/admin/users             add or update a user
+//	DELETE /api/admin/users/{uid}       remove a user
+//	PATCH  /api/admin/users/{uid}       change a user
+//	POST   /api/admin/users/{uid}/reset reset the used traffic
+//	GET    /api/admin/nodes             list nodes
+//
+// The node routes are authenticated with the RegisterToken, the admin routes with the ManagerAdminToken.
+type Manager struct {
+	cfg    *Config
+	store  *Store
+	nonces *schema.NonceCache
+	svr    *http.Server
+
+	mu          sync.Mutex
+	subscribers map[chan event]struct{}
+}
+
+func New(c *Config, store *Store) *Manager {
+	m := &Manager{
+		cfg:         c,
+		store:       store,
+		nonces:      schema.NewNonceCache(),
+		subscribers: make(map[chan event]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/node", m.auth(m.nodeReport))
+	mux.HandleFunc("GET /api/node/config", m.auth(m.nodeConfig))
+	mux.HandleFunc("GET /api/node/stream", m.auth(m.nodeStream))
+	mux.HandleFunc("GET /api/admin/users", m.adminAuth(m.listUsers))
+	mux.HandleFunc("POST /api/admin/users", m.adminAuth(m.putUser))
+	mux.HandleFunc("DELETE /api/admin/users/{uid}", m.adminAuth(m.removeUser))
+	mux.HandleFunc("PATCH /api/admin/users/{uid}", m.adminAuth(m.patchUser))
+	mux.HandleFunc("POST /api/admin/users/{uid}/reset", m.adminAuth(m.resetUser))
+	mux.HandleFunc("GET /api/admin/nodes", m.adminAuth(m.listNodes))
+	m.svr = &http.Server{
+		Addr:        c.ManagerListen,
+		Handler:     mux,
+		ReadTimeout: 30 * time.Second,
+		IdleTimeout: 60 * time.Second,
+	}
+	return m
+}
+
+func (m *Manager) Run() error {
+	log.Println("manager starting on http://" + m.svr.Addr)
+	go m.loopPing()
+	err := m.svr.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (m *Manager) Shutdown(ctx context.Context) error {
+	return m.svr.Shutdown(ctx)
+}
+
+type ctxKey struct{}
+
+// auth checks the request is signed with, or carries, the RegisterToken shared with the nodes.
+// The body is read here, handlers get it back from r.Body, and the request nonce is kept for the response signature.
+func (m *Manager) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if m.cfg.Signed() {
+			if err := schema.VerifyRequest(r, body, m.cfg.RegisterToken, time.Now()); err != nil {
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			nonce := r.Header.Get(schema.HeaderNonce)
+			if !m.nonces.Check(nonce, time.Now()) {
+				http.Error(w, "unauthorized: replayed request", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, nonce))
+		} else {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(m.cfg.RegisterToken)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// adminAuth checks the request carries the ManagerAdminToken, a node's RegisterToken is not enough
+// to change users. The admin API is off without a ManagerAdminToken.
+func (m *Manager) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.cfg.ManagerAdminToken == "" {
+			http.Error(w, "admin api disabled, set ManagerAdminToken", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.cfg.ManagerAdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		next(w, r)
+	}
+}
+
+func requestNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(ctxKey{}).(string)
+	return nonce
+}
+
+// writeJSON writes a response signed for the request nonce when HMAC is on, admin responses are not signed.
+func (m *Manager) writeJSON(w http.ResponseWriter, r *http.Request, status int, data any) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.cfg.Signed() && requestNonce(r) != "" {
+		schema.SignResponse(w.Header(), requestNonce(r), body, m.cfg.RegisterToken)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (m *Manager) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	m.writeJSON(w, r, status, map[string]string{"error": msg})
+}
+
+func (m *Manager) nodeReport(w http.ResponseWriter, r *http.Request) {
+	stat := &schema.AppStat{}
+	if err := json.NewDecoder(r.Body).Decode(stat); err != nil {
+		m.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if stat.ReportID == "" {
+		stat.ReportID = r.Header.Get("Idempotency-Key")
+	}
+	exhausted, err := m.store.ApplyReport(stat, r.RemoteAddr)
+	if err != nil {
+		m.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("node report", "hostname", stat.Hostname, "report_id", stat.ReportID, "users", len(stat.Traffic))
+	if len(exhausted) > 0 {
+		slog.Info("users out of quota", "users", exhausted)
+		m.publishRemove(exhausted)
+	}
+	m.writeJSON(w, r, http.StatusOK, m.store.Allowed())
+}
+
+func (m *Manager) nodeConfig(w http.ResponseWriter, r *http.Request) {
+	nc := schema.NodeConfig{Users: m.store.NodeUsers()}
+	if file := m.cfg.ManagerRoutingFile; file != "" {
+		// read on every pull so an edit reaches the nodes without a restart
+		data, err := os.ReadFile(file)
+		if err == nil {
+			_, err = routing.Parse(string(data), "")
+		}
+		if err != nil {
+			slog.Warn("routing rules not sent to the nodes", "file", file, "err", err)
+		} else {
+			nc.Routing = string(data)
+		}
+	}
+	raw, _ := json.Marshal(nc)
+	sum := sha256.Sum256(raw)
+	nc.Version = hex.EncodeToString(sum[:8])
+	etag := strconv.Quote(nc.Version)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		// signed over the ETag it confirms, an unsigned 304 would let anyone on the path pin a node to a stale config
+		if m.cfg.Signed() && requestNonce(r) != "" {
+			schema.SignResponse(w.Header(), requestNonce(r), []byte(etag), m.cfg.RegisterToken)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	m.writeJSON(w, r, http.StatusOK, nc)
+}
+
+func (m *Manager) subscribe() chan event {
+	ch := make(chan event, 64)
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+	return ch
+}
+
+func (m *Manager) unsubscribe(ch chan event) {
+	m.mu.Lock()
+	delete(m.subscribers, ch)
+	m.mu.Unlock()
+}
+
+// publish sends the event to every connected node, a node too slow to keep up misses it
+// and catches up with its next push.
+func (m *Manager) publish(name string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("encoding event", "err", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- event{name: name, data: raw}:
+		default:
+		}
+	}
+}
+
+func (m *Manager) publishUpsert(u User) {
+	if !u.Allowed() {
+		m.publishRemove([]string{u.UID})
+		return
+	}
+	m.publish(schema.EventUsersUpsert, []schema.NodeUser{nodeUser(u)})
+}
+
+func (m *Manager) publishRemove(uids []string) {
+	m.publish(schema.EventUsersRemove, uids)
+}
+
+func (m *Manager) loopPing() {
+	tk := time.NewTicker(pingInterval)
+	defer tk.Stop()
+	for range tk.C {
+		m.publish(schema.EventPing, time.Now().Unix())
+	}
+}
+
+func (m *Manager) nodeStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	rc.SetReadDeadline(time.Time{})
+	ch := m.subscribe()
+	defer m.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	nonce := requestNonce(r)
+	seq := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			seq++
+			id := strconv.Itoa(seq)
+			msg := fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n", id, ev.name, ev.data)
+			if m.cfg.Signed() {
+				msg += "sig: " + schema.SignEvent(m.cfg.RegisterToken, nonce, id, ev.name, ev.data) + "\n"
+			}
+			if _, err := io.WriteString(w, msg+"\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (m *Manager) listUsers(w http.ResponseWriter, r *http.Request) {
+	m.writeJSON(w, r, http.StatusOK, m.store.Users())
+}
+
+func (m *Manager) listNodes(w http.ResponseWriter, r *http.Request) {
+	m.writeJSON(w, r, http.StatusOK, m.store.Nodes())
+}
+
+// UserArgs are the fields of a user the admin API can set, nil fields are left unchanged.
+type UserArgs struct {
+	UID         string          `json:"uid,omitempty"`
+	Note        *string         `json:"note,omitempty"`
+	Disabled    *bool           `json:"disabled,omitempty"`
+	QuotaKb     *int64          `json:"quota_kb,omitempty"`
+	MaxSessions *int64          `json:"max_sessions,omitempty"`
+	ACL         *schema.DstACL  `json:"acl,omitempty"`      //an empty acl clears it
+	Outbound    *string         `json:"outbound,omitempty"` //an empty outbound clears it
+	SockOpt     *schema.SockOpt `json:"sockopt,omitempty"`  //empty options clear them
+}
+
+func (a UserArgs) apply(u *User) {
+	if a.Note != nil {
+		u.Note = *a.Note
+	}
+	if a.Disabled != nil {
+		u.Disabled = *a.Disabled
+	}
+	if a.QuotaKb != nil {
+		u.QuotaKb = max(*a.QuotaKb, 0)
+	}
+	if a.MaxSessions != nil {
+		u.MaxSessions = max(*a.MaxSessions, 0)
+	}
+	if a.Outbound != nil {
+		u.Outbound = *a.Outbound
+	}
+	if a.ACL != nil {
+		u.ACL = a.ACL
+		if reflect.DeepEqual(*a.ACL, schema.DstACL{}) {
+			u.ACL = nil
+		}
+	}
+	if a.SockOpt != nil {
+		u.SockOpt = a.SockOpt
+		if *a.SockOpt == (schema.SockOpt{}) {
+			u.SockOpt = nil
+		}
+	}
+}
+
+func pathUID(r *http.Request) (string, bool) {
+	id, err := uuid.Parse(r.PathValue("uid"))
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+func (m *Manager) putUser(w http.ResponseWriter, r *http.Request) {
+	args := UserArgs{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		m.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := uuid.Parse(args.UID)
+	if err != nil {
+		m.writeError(w, r, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+	u, ok := m.store.User(id.String())
+	if !ok {
+		u = User{UID: id.String()}
+	}
+	args.apply(&u)
+	u, err = m.store.PutUser(u)
+	if err != nil {
+		m.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	m.publishUpsert(u)
+	m.writeJSON(w, r, http.StatusOK, u)
+}
+
+func (m *Manager) patchUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := pathUID(r)
+	if !ok {
+		m.writeError(w, r, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+	args := UserArgs{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		m.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	m.updateUser(w, r, uid, args.apply)
+}
+
+func (m *Manager) resetUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := pathUID(r)
+	if !ok {
+		m.writeError(w, r, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+	m.updateUser(w, r, uid, func(u *User) { u.UsedKb, u.UsedUpKb, u.UsedDownKb = 0, 0, 0 })
+}
+
+func (m *Manager) updateUser(w http.ResponseWriter, r *http.Request, uid string, fn func(u *User)) {
+	u, ok, err := m.store.UpdateUser(uid, fn)
+	if err != nil {
+		m.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		m.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	m.publishUpsert(u)
+	m.writeJSON(w, r, http.StatusOK, u)
+}
+
+func (m *Manager) removeUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := pathUID(r)
+	if !ok {
+		m.writeError(w, r, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+	ok, err := m.store.RemoveUser(uid)
+	if err != nil {
+		m.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		m.writeError(w, r, http.StatusNotFound, "user not found")
+		return
+	}
+	m.publishRemove([]string{uid})
+	m.writeJSON(w, r, http.StatusOK, map[string]string{"removed": uid})
+}
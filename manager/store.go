@@ -0,0 +1,274 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unchainese/unchain/global"
+	"github.com/unchainese/unchain/schema"
+)
+
+// how long report idempotency keys are remembered
+const reportKeyTTL = 7 * 24 * time.Hour
+
+// User is a user of the control plane and its quota.
+type User struct {
+	UID         string           `json:"uid"`
+	Note        string           `json:"note,omitempty"`
+	Disabled    bool             `json:"disabled"`
+	QuotaKb     int64            `json:"quota_kb"` //0 means unlimited
+	UsedKb      int64            `json:"used_kb"`
+	UsedUpKb    int64            `json:"used_up_kb"`
+	UsedDownKb  int64            `json:"used_down_kb"`
+	MaxSessions int64            `json:"max_sessions"`         //per node, 0 means unlimited
+	ACL         *schema.DstACL   `json:"acl,omitempty"`        //destination overrides sent to the nodes
+	Outbound    string           `json:"outbound,omitempty"`   //routing outbound tag sent to the nodes
+	SockOpt     *schema.SockOpt  `json:"sockopt,omitempty"`    //direct socket options sent to the nodes
+	Detections  map[string]int64 `json:"detections,omitempty"` //sniffed protocol -> sessions reported by the nodes
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// AvailableKb returns the KB left, 0 means unlimited.
+func (u User) AvailableKb() int64 {
+	if u.QuotaKb == 0 {
+		return 0
+	}
+	return u.QuotaKb - u.UsedKb
+}
+
+// Allowed reports whether the user may connect to the nodes.
+func (u User) Allowed() bool {
+	return !u.Disabled && (u.QuotaKb == 0 || u.UsedKb < u.QuotaKb)
+}
+
+// Node is the last report of a node.
+type Node struct {
+	Hostname     string                 `json:"hostname"`
+	SubAddresses []string               `json:"sub_addresses"`
+	VersionInfo  string                 `json:"version_info"`
+	Goroutine    int64                  `json:"goroutine"`
+	TrafficKb    int64                  `json:"traffic_kb"` //total reported
+	LastSeen     time.Time              `json:"last_seen"`
+	RemoteAddr   string                 `json:"remote_addr"`
+	StatVersion  int                    `json:"stat_version"`
+	Load         *schema.NodeLoad       `json:"load,omitempty"`       //nil for nodes older than AppStat version 2
+	Groups       []schema.OutboundGroup `json:"groups,omitempty"`     //routing outbound groups, since AppStat version 3
+	Detections   map[string]int64       `json:"detections,omitempty"` //sniffed protocol -> sessions reported, since AppStat version 4
+}
+
+type storeData struct {
+	Users   map[string]*User     `json:"users"`
+	Nodes   map[string]*Node     `json:"nodes"`
+	Reports map[string]time.Time `json:"reports"` //idempotency keys of the applied reports
+}
+
+// Store is the manager database, a JSON file rewritten atomically on every change.
+type Store struct {
+	mu   sync.Mutex
+	file string
+	data storeData
+}
+
+func OpenStore(file string) (*Store, error) {
+	s := &Store{file: file, data: storeData{
+		Users:   make(map[string]*User),
+		Nodes:   make(map[string]*Node),
+		Reports: make(map[string]time.Time),
+	}}
+	raw, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, fmt.Errorf("decoding manager db %s: %w", file, err)
+	}
+	if s.data.Users == nil {
+		s.data.Users = make(map[string]*User)
+	}
+	if s.data.Nodes == nil {
+		s.data.Nodes = make(map[string]*Node)
+	}
+	if s.data.Reports == nil {
+		s.data.Reports = make(map[string]time.Time)
+	}
+	return s, nil
+}
+
+// saveLocked writes the database, the caller holds s.mu.
+func (s *Store) saveLocked() error {
+	now := time.Now()
+	for id, at := range s.data.Reports {
+		if now.Sub(at) > reportKeyTTL {
+			delete(s.data.Reports, id)
+		}
+	}
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return global.WriteFileAtomic(s.file, raw)
+}
+
+func (s *Store) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]User, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		res = append(res, *u)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UID < res[j].UID })
+	return res
+}
+
+func (s *Store) User(uid string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[uid]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+func (s *Store) Nodes() []Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Node, 0, len(s.data.Nodes))
+	for _, n := range s.data.Nodes {
+		res = append(res, *n)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Hostname < res[j].Hostname })
+	return res
+}
+
+// PutUser adds a user or replaces its settings, the used traffic is kept.
+func (s *Store) PutUser(u User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.data.Users[u.UID]; ok {
+		u.UsedKb, u.UsedUpKb, u.UsedDownKb = old.UsedKb, old.UsedUpKb, old.UsedDownKb
+		u.CreatedAt = old.CreatedAt
+	} else {
+		u.CreatedAt = time.Now()
+	}
+	s.data.Users[u.UID] = &u
+	return u, s.saveLocked()
+}
+
+// UpdateUser applies fn to the user and saves it, it returns false if the user does not exist.
+func (s *Store) UpdateUser(uid string, fn func(u *User)) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[uid]
+	if !ok {
+		return User{}, false, nil
+	}
+	fn(u)
+	return *u, true, s.saveLocked()
+}
+
+func (s *Store) RemoveUser(uid string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Users[uid]; !ok {
+		return false, nil
+	}
+	delete(s.data.Users, uid)
+	return true, s.saveLocked()
+}
+
+// ApplyReport adds the traffic of a node report to the users, a report ID applied before is ignored.
+// It returns the users that ran out of quota because of this report.
+func (s *Store) ApplyReport(stat *schema.AppStat, remoteAddr string) (exhausted []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	node, ok := s.data.Nodes[stat.Hostname]
+	if !ok {
+		node = &Node{Hostname: stat.Hostname}
+		s.data.Nodes[stat.Hostname] = node
+	}
+	node.SubAddresses = stat.SubAddresses
+	node.VersionInfo = stat.VersionInfo
+	node.Goroutine = stat.Goroutine
+	node.LastSeen = now
+	node.RemoteAddr = remoteAddr
+	node.StatVersion = max(stat.StatVersion, 1)
+	node.Load = stat.Load
+	node.Groups = stat.Groups
+
+	if stat.ReportID != "" {
+		if _, seen := s.data.Reports[stat.ReportID]; seen {
+			return nil, s.saveLocked()
+		}
+		s.data.Reports[stat.ReportID] = now
+	}
+	for uid, kb := range stat.Traffic {
+		node.TrafficKb += kb
+		u, ok := s.data.Users[uid]
+		if !ok {
+			continue
+		}
+		wasAllowed := u.Allowed()
+		u.UsedKb += kb
+		u.UsedUpKb += stat.TrafficUp[uid]
+		u.UsedDownKb += stat.TrafficDown[uid]
+		if wasAllowed && !u.Allowed() {
+			exhausted = append(exhausted, uid)
+		}
+	}
+	for uid, counts := range stat.Detections {
+		for protocol, n := range counts {
+			if node.Detections == nil {
+				node.Detections = make(map[string]int64)
+			}
+			node.Detections[protocol] += n
+			if u, ok := s.data.Users[uid]; ok {
+				if u.Detections == nil {
+					u.Detections = make(map[string]int64)
+				}
+				u.Detections[protocol] += n
+			}
+		}
+	}
+	return exhausted, s.saveLocked()
+}
+
+// Allowed returns the allowed users with their available KB, the answer to a node push.
+func (s *Store) Allowed() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]int64)
+	for uid, u := range s.data.Users {
+		if u.Allowed() {
+			res[uid] = u.AvailableKb()
+		}
+	}
+	return res
+}
+
+// NodeUsers returns the allowed users with their limits, for the node config and the stream.
+func (s *Store) NodeUsers() []schema.NodeUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]schema.NodeUser, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		if u.Allowed() {
+			res = append(res, nodeUser(*u))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UID < res[j].UID })
+	return res
+}
+
+func nodeUser(u User) schema.NodeUser {
+	return schema.NodeUser{UID: u.UID, QuotaKb: u.AvailableKb(), MaxSessions: u.MaxSessions, ACL: u.ACL, Outbound: u.Outbound, SockOpt: u.SockOpt}
+}
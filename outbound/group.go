@@ -0,0 +1,296 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+// DefaultProbe is probed through the members of a group without probe.
+const DefaultProbe = "https://www.gstatic.com/generate_204"
+
+const (
+	defaultProbeInterval = time.Minute
+	probeTimeout         = 5 * time.Second
+)
+
+type groupMember struct {
+	tag       string
+	dialer    Dialer
+	healthy   atomic.Bool
+	latency   atomic.Int64 //nanoseconds of the last successful probe, 0 before it
+	active    atomic.Int64 //open connections
+	mu        sync.Mutex
+	lastProbe time.Time
+	lastErr   string
+}
+
+// Group spreads the connections over its members with a strategy, members failing the probe
+// are left out until they pass it again. A failed dial tries the next member.
+type Group struct {
+	tag      string
+	strategy string
+	members  []*groupMember
+	probe    string
+	interval time.Duration
+	next     atomic.Uint64
+
+	usersMu sync.Mutex
+	users   map[string]*groupUser //users with open connections
+}
+
+type groupUser struct {
+	member string //member of the user's last connection
+	conns  int
+}
+
+// NewGroup builds a group of the dialers of its members.
+func NewGroup(oc routing.OutboundConfig, dialers map[string]Dialer) (*Group, error) {
+	g := &Group{
+		tag:      oc.Tag,
+		strategy: oc.Strategy,
+		probe:    oc.Probe,
+		interval: time.Duration(oc.ProbeInterval) * time.Second,
+		users:    make(map[string]*groupUser),
+	}
+	if g.strategy == "" {
+		g.strategy = routing.StrategyRoundRobin
+	}
+	if g.probe == "" {
+		g.probe = DefaultProbe
+	}
+	if g.interval <= 0 {
+		g.interval = defaultProbeInterval
+	}
+	for _, tag := range oc.Members {
+		d, ok := dialers[tag]
+		if !ok {
+			return nil, fmt.Errorf("group %q: member %q has no dialer", oc.Tag, tag)
+		}
+		m := &groupMember{tag: tag, dialer: d}
+		m.healthy.Store(true)
+		g.members = append(g.members, m)
+	}
+	return g, nil
+}
+
+// candidates returns the members in the order to try them, the healthy ones first.
+func (g *Group) candidates() []*groupMember {
+	healthy := make([]*groupMember, 0, len(g.members))
+	unhealthy := make([]*groupMember, 0)
+	for _, m := range g.members {
+		if m.healthy.Load() {
+			healthy = append(healthy, m)
+		} else {
+			unhealthy = append(unhealthy, m)
+		}
+	}
+	if n := len(healthy); n > 1 {
+		first := 0
+		switch g.strategy {
+		case routing.StrategyRoundRobin:
+			first = int(g.next.Add(1)-1) % n
+		case routing.StrategyRandom:
+			first = rand.IntN(n)
+		case routing.StrategyLeastConn:
+			for i, m := range healthy {
+				if m.active.Load() < healthy[first].active.Load() {
+					first = i
+				}
+			}
+		case routing.StrategyLeastLatency:
+			for i, m := range healthy {
+				if l := m.latency.Load(); l > 0 && (healthy[first].latency.Load() == 0 || l < healthy[first].latency.Load()) {
+					first = i
+				}
+			}
+		}
+		healthy = append(healthy[first:], healthy[:first]...)
+	}
+	// when every member failed its probe they are still tried, the probe target may be the one down
+	return append(healthy, unhealthy...)
+}
+
+func (g *Group) Dial(ctx context.Context, req *Request) (net.Conn, error) {
+	errs := make([]error, 0)
+	for _, m := range g.candidates() {
+		conn, err := m.dialer.Dial(ctx, req)
+		if err == nil {
+			m.active.Add(1)
+			g.usersMu.Lock()
+			u := g.users[req.User]
+			if u == nil {
+				u = &groupUser{}
+				g.users[req.User] = u
+			}
+			u.member = m.tag
+			u.conns++
+			g.usersMu.Unlock()
+			return &countedConn{Conn: conn, release: func() {
+				m.active.Add(-1)
+				g.release(req.User)
+			}}, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.tag, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("group %s: %w", g.tag, errors.Join(errs...))
+}
+
+// release drops the user from the group state once its last connection is closed.
+func (g *Group) release(uid string) {
+	g.usersMu.Lock()
+	defer g.usersMu.Unlock()
+	if u := g.users[uid]; u != nil {
+		u.conns--
+		if u.conns <= 0 {
+			delete(g.users, uid)
+		}
+	}
+}
+
+func (g *Group) Tag() string {
+	return g.tag
+}
+
+// Run probes the members until ctx is done.
+func (g *Group) Run(ctx context.Context) {
+	for {
+		var wg sync.WaitGroup
+		for _, m := range g.members {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.probeMember(ctx, m)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(g.interval):
+		}
+	}
+}
+
+func (g *Group) probeMember(ctx context.Context, m *groupMember) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	start := time.Now()
+	err := probe(ctx, m.dialer, g.probe)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	m.mu.Lock()
+	m.lastProbe, m.lastErr = start, ""
+	if err != nil {
+		m.lastErr = err.Error()
+	}
+	m.mu.Unlock()
+	if err != nil {
+		if m.healthy.Swap(false) {
+			slog.Warn("outbound group member ejected", "group", g.tag, "member", m.tag, "err", err)
+		}
+		return
+	}
+	m.latency.Store(int64(time.Since(start)))
+	if !m.healthy.Swap(true) {
+		slog.Info("outbound group member healthy again", "group", g.tag, "member", m.tag)
+	}
+}
+
+// probe connects to a tcp://host:port target, or requests an http(s) URL and expects a status below 500.
+func probe(ctx context.Context, d Dialer, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "tcp" {
+		port, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return fmt.Errorf("probe %s: bad port", target)
+		}
+		conn, err := d.Dial(ctx, &Request{Network: "tcp", Host: u.Hostname(), Port: uint16(port)})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			p, _ := strconv.ParseUint(port, 10, 16)
+			return d.Dial(ctx, &Request{Network: "tcp", Host: host, Port: uint16(p)})
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("probe %s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+// Stat returns the state of the group for the node report.
+func (g *Group) Stat() schema.OutboundGroup {
+	res := schema.OutboundGroup{Tag: g.tag, Strategy: g.strategy, Probe: g.probe, Members: make([]schema.OutboundMember, 0, len(g.members))}
+	for _, m := range g.members {
+		m.mu.Lock()
+		ms := schema.OutboundMember{
+			Tag:       m.tag,
+			Healthy:   m.healthy.Load(),
+			LatencyMs: time.Duration(m.latency.Load()).Milliseconds(),
+			Active:    m.active.Load(),
+			LastProbe: m.lastProbe,
+			Error:     m.lastErr,
+		}
+		m.mu.Unlock()
+		res.Members = append(res.Members, ms)
+	}
+	g.usersMu.Lock()
+	res.Users = make(map[string]string, len(g.users))
+	for uid, u := range g.users {
+		res.Users[uid] = u.member
+	}
+	g.usersMu.Unlock()
+	return res
+}
+
+// countedConn counts an open connection of a member and its user until it is closed.
+type countedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
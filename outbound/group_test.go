@@ -0,0 +1,50 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/unchainese/unchain/routing"
+)
+
+type pipeDialer struct{}
+
+func (pipeDialer) Dial(context.Context, *Request) (net.Conn, error) {
+	c, s := net.Pipe()
+	s.Close()
+	return c, nil
+}
+
+func TestGroupUsers(t *testing.T) {
+	g, err := NewGroup(routing.OutboundConfig{Tag: "g", Members: []string{"a", "b"}}, map[string]Dialer{"a": pipeDialer{}, "b": pipeDialer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c1, err := g.Dial(ctx, &Request{Network: "tcp", Host: "example.com", Port: 80, User: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := g.Dial(ctx, &Request{Network: "tcp", Host: "example.com", Port: 80, User: "u1"})
+	c3, _ := g.Dial(ctx, &Request{Network: "tcp", Host: "example.com", Port: 80, User: "u2"})
+	if st := g.Stat(); len(st.Users) != 2 || st.Users["u1"] != "b" || st.Users["u2"] != "a" {
+		t.Fatalf("users = %v, want u1 on b and u2 on a", st.Users)
+	}
+	c1.Close()
+	c1.Close()
+	if st := g.Stat(); st.Users["u1"] != "b" {
+		t.Fatalf("u1 dropped with a connection still open: %v", st.Users)
+	}
+	c2.Close()
+	c3.Close()
+	st := g.Stat()
+	if len(st.Users) != 0 {
+		t.Errorf("users = %v after every connection closed, want none", st.Users)
+	}
+	for _, m := range st.Members {
+		if m.Active != 0 {
+			t.Errorf("member %s has %d active connections", m.Tag, m.Active)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// httpProxy tunnels TCP through an HTTP proxy with CONNECT, it has no UDP.
+type httpProxy struct {
+	server             string
+	username, password string
+	dialer             net.Dialer
+}
+
+func (h *httpProxy) Dial(ctx context.Context, req *Request) (net.Conn, error) {
+	if req.Network != "tcp" {
+		return nil, fmt.Errorf("http proxy %s: %w: %s", h.server, ErrUnsupported, req.Network)
+	}
+	if !validConnectHost(req.Host) {
+		return nil, fmt.Errorf("http proxy %s: invalid host %q", h.server, req.Host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	conn, err := h.dialer.DialContext(ctx, "tcp", h.server)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %w", h.server, err)
+	}
+	var br *bufio.Reader
+	err = handshake(ctx, conn, func() error {
+		msg := "CONNECT " + req.Addr() + " HTTP/1.1\r\nHost: " + req.Addr() + "\r\n"
+		if h.username != "" {
+			msg += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(h.username+":"+h.password)) + "\r\n"
+		}
+		if _, err := conn.Write([]byte(msg + "\r\n")); err != nil {
+			return err
+		}
+		br = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("CONNECT %s: %s", req.Addr(), resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", h.server, err)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// validConnectHost reports whether host can go into the CONNECT request line and Host header as is,
+// control characters and spaces would inject headers or requests.
+func validConnectHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// bufferedConn returns the bytes the handshake read ahead before reading the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,64 @@
+// Package outbound connects sessions to their destination through upstream proxies.
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unchainese/unchain/routing"
+)
+
+// DialTimeout bounds connecting to an upstream and its handshake.
+const DialTimeout = 10 * time.Second
+
+var ErrUnsupported = errors.New("network not supported by the outbound")
+
+// Request is a connection to open through an outbound.
+type Request struct {
+	Network string //tcp or udp
+	Host    string //destination domain or IP, a proxy resolves domains itself
+	Port    uint16
+	User    string
+}
+
+func (r *Request) Addr() string {
+	return net.JoinHostPort(strings.Trim(r.Host, "[]"), strconv.Itoa(int(r.Port)))
+}
+
+// Dialer opens connections through an outbound. A udp connection keeps the datagram boundaries,
+// a Write sends one datagram and a Read returns one.
+type Dialer interface {
+	Dial(ctx context.Context, req *Request) (net.Conn, error)
+}
+
+// New builds the dialer of a proxy outbound, the direct and block outbounds belong to the caller.
+// A dialer that is an io.Closer holds resources, the caller closes it when it is no longer used.
+func New(oc routing.OutboundConfig) (Dialer, error) {
+	switch oc.Type {
+	case routing.OutboundSOCKS5:
+		return &socks5{server: oc.Server, username: oc.Username, password: oc.Password}, nil
+	case routing.OutboundHTTP:
+		return &httpProxy{server: oc.Server, username: oc.Username, password: oc.Password}, nil
+	case routing.OutboundVLESS:
+		return newVLESSWS(oc.Server, oc.UUID, oc.Path, oc.Host, oc.SNI, oc.TLS, oc.Insecure), nil
+	case routing.OutboundWireGuard:
+		return newWireGuard(oc)
+	default:
+		return nil, fmt.Errorf("outbound %q: unknown type %q", oc.Tag, oc.Type)
+	}
+}
+
+// handshake runs fn with the connection deadline of ctx and clears it afterwards.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	err := fn()
+	conn.SetDeadline(time.Time{})
+	return err
+}
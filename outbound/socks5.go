@@ -0,0 +1,259 @@
+package outbound
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 client, RFC 1928 with the username/password authentication of RFC 1929
+const (
+	socksVersion5      = 0x05
+	socksAuthNone      = 0x00
+	socksAuthPassword  = 0x02
+	socksAuthNoMethod  = 0xff
+	socksCmdConnect    = 0x01
+	socksCmdUDP        = 0x03
+	socksAddrIPv4      = 0x01
+	socksAddrDomain    = 0x03
+	socksAddrIPv6      = 0x04
+	socksReplySuccess  = 0x00
+	socksMaxPacketSize = 65535
+)
+
+type socks5 struct {
+	server             string
+	username, password string
+	dialer             net.Dialer
+}
+
+func (s *socks5) Dial(ctx context.Context, req *Request) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.server)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 %s: %w", s.server, err)
+	}
+	var bound string
+	err = handshake(ctx, conn, func() error {
+		if err := s.auth(conn); err != nil {
+			return err
+		}
+		if req.Network == "udp" {
+			// the client address of the association is unknown before the relay socket exists
+			bound, err = socksRequest(conn, socksCmdUDP, "0.0.0.0", 0)
+		} else {
+			bound, err = socksRequest(conn, socksCmdConnect, req.Host, req.Port)
+		}
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %w", s.server, err)
+	}
+	if req.Network != "udp" {
+		return conn, nil
+	}
+	relay, err := s.relayAddr(bound)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %w", s.server, err)
+	}
+	pc, err := s.dialer.DialContext(ctx, "udp", relay)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s udp relay %s: %w", s.server, relay, err)
+	}
+	header, err := socksAddr(req.Host, req.Port)
+	if err != nil {
+		conn.Close()
+		pc.Close()
+		return nil, err
+	}
+	return &socksPacketConn{Conn: pc, ctrl: conn, header: append([]byte{0, 0, 0}, header...)}, nil
+}
+
+// relayAddr is the UDP relay of the association, an unspecified address means the proxy host.
+func (s *socks5) relayAddr(bound string) (string, error) {
+	host, port, err := net.SplitHostPort(bound)
+	if err != nil {
+		return "", err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsUnspecified() {
+		if host, _, err = net.SplitHostPort(s.server); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (s *socks5) auth(conn net.Conn) error {
+	method := byte(socksAuthNone)
+	if s.username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion5, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion5 || resp[1] == socksAuthNoMethod || resp[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == socksAuthNone {
+		return nil
+	}
+	if len(s.username) > 255 || len(s.password) > 255 {
+		return errors.New("username or password too long")
+	}
+	msg := []byte{0x01, byte(len(s.username))}
+	msg = append(msg, s.username...)
+	msg = append(msg, byte(len(s.password)))
+	msg = append(msg, s.password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// socksAddr encodes ATYP, DST.ADDR and DST.PORT.
+func socksAddr(host string, port uint16) ([]byte, error) {
+	host = strings.Trim(host, "[]")
+	var b []byte
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Unmap().Is4() {
+			b = append([]byte{socksAddrIPv4}, ip.Unmap().AsSlice()...)
+		} else {
+			b = append([]byte{socksAddrIPv6}, ip.AsSlice()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain too long: %s", host)
+		}
+		b = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// readSocksAddr reads ATYP, ADDR and PORT and returns them as host:port.
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		b := make([]byte, 4)
+		if atyp[0] == socksAddrIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case socksAddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksRequest sends a command and returns the bound address of the reply.
+func socksRequest(conn net.Conn, cmd byte, host string, port uint16) (string, error) {
+	addr, err := socksAddr(host, port)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(append([]byte{socksVersion5, cmd, 0x00}, addr...)); err != nil {
+		return "", err
+	}
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return "", err
+	}
+	if resp[0] != socksVersion5 {
+		return "", fmt.Errorf("unexpected version %d", resp[0])
+	}
+	if resp[1] != socksReplySuccess {
+		return "", fmt.Errorf("request failed with reply %d", resp[1])
+	}
+	return readSocksAddr(conn)
+}
+
+// socksPacketConn is a UDP association, every datagram carries the destination header.
+// The association lives as long as its TCP control connection.
+type socksPacketConn struct {
+	net.Conn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socksPacketConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(append(c.header[:len(c.header):len(c.header)], p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) Read(p []byte) (int, error) {
+	buf := make([]byte, socksMaxPacketSize)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 { //fragments are not supported, drop them
+			continue
+		}
+		r := &sliceReader{b: buf[3:n]}
+		if _, err := readSocksAddr(r); err != nil {
+			continue
+		}
+		return copy(p, r.b), nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+type sliceReader struct{ b []byte }
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
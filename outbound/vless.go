@@ -0,0 +1,200 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/unchainese/unchain/schema"
+)
+
+// vlessWS relays through another unchain or Xray node with VLESS over WebSocket.
+type vlessWS struct {
+	uid    string
+	url    string //ws:// or wss:// URL of the server address and path
+	host   string //Host header, the server host when empty
+	dialer *websocket.Dialer
+}
+
+func newVLESSWS(server, uid, path, host, sni string, useTLS, insecure bool) *vlessWS {
+	scheme := "ws"
+	var tlsConf *tls.Config
+	if useTLS {
+		scheme = "wss"
+		if sni == "" {
+			sni = host
+		}
+		if sni == "" {
+			sni, _, _ = net.SplitHostPort(server)
+		}
+		tlsConf = &tls.Config{ServerName: sni, InsecureSkipVerify: insecure}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return &vlessWS{
+		uid:  uid,
+		url:  scheme + "://" + server + path,
+		host: host,
+		dialer: &websocket.Dialer{
+			NetDialContext:   (&net.Dialer{}).DialContext,
+			TLSClientConfig:  tlsConf,
+			HandshakeTimeout: DialTimeout,
+		},
+	}
+}
+
+// NewVLESSURL returns a VLESS over WebSocket dialer of a ws:// or wss:// URL.
+func NewVLESSURL(rawURL, uid string) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	path := u.Path
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return newVLESSWS(net.JoinHostPort(u.Hostname(), port), uid, path, "", "", u.Scheme == "wss", false), nil
+}
+
+func (v *vlessWS) Dial(ctx context.Context, req *Request) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	header := http.Header{}
+	if v.host != "" {
+		header.Set("Host", v.host)
+	}
+	ws, _, err := v.dialer.DialContext(ctx, v.url, header)
+	if err != nil {
+		return nil, fmt.Errorf("vless %s: %w", v.url, err)
+	}
+	c := &vlessConn{
+		ws:     ws,
+		udp:    req.Network == "udp",
+		header: schema.MakeVless(v.uid, strings.Trim(req.Host, "[]"), req.Port, req.Network, nil).DataHeader(),
+	}
+	// a tcp destination may speak first, the server only dials it once it has the header
+	if !c.udp {
+		ws.SetWriteDeadline(time.Now().Add(DialTimeout))
+		err = ws.WriteMessage(websocket.BinaryMessage, c.header)
+		ws.SetWriteDeadline(time.Time{})
+		if err != nil {
+			ws.Close()
+			return nil, fmt.Errorf("vless %s: %w", v.url, err)
+		}
+		c.header = nil
+	}
+	return c, nil
+}
+
+// vlessConn is a VLESS session on a WebSocket. The request header of a tcp session is sent on dial,
+// a udp session sends it with the first datagram as the server expects.
+// The response header is stripped from the first read. A udp session frames every datagram with its length.
+type vlessConn struct {
+	ws  *websocket.Conn
+	udp bool
+
+	writeMu sync.Mutex
+	header  []byte //sent with the first udp write, nil afterwards
+
+	readHeader bool
+	pending    []byte //read but not yet returned
+}
+
+func (c *vlessConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	data := p
+	if c.udp {
+		data = binary.BigEndian.AppendUint16(make([]byte, 0, len(p)+2), uint16(len(p)))
+		data = append(data, p...)
+	}
+	if c.header != nil {
+		data = append(c.header, data...)
+		c.header = nil
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *vlessConn) Read(p []byte) (int, error) {
+	for {
+		if c.udp {
+			if n, ok, err := c.readDatagram(p); ok || err != nil {
+				return n, err
+			}
+		} else if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		mt, msg, err := c.ws.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		c.pending = append(c.pending, msg...)
+		if !c.readHeader {
+			// version, addons length, addons
+			if len(c.pending) < 2 || len(c.pending) < 2+int(c.pending[1]) {
+				continue
+			}
+			c.pending = c.pending[2+int(c.pending[1]):]
+			c.readHeader = true
+		}
+	}
+}
+
+// readDatagram returns the next length framed datagram, ok is false until a whole one was read.
+func (c *vlessConn) readDatagram(p []byte) (int, bool, error) {
+	if !c.readHeader || len(c.pending) < 2 {
+		return 0, false, nil
+	}
+	n := int(binary.BigEndian.Uint16(c.pending))
+	if len(c.pending) < 2+n {
+		return 0, false, nil
+	}
+	copied := copy(p, c.pending[2:2+n])
+	c.pending = c.pending[2+n:]
+	return copied, true, nil
+}
+
+func (c *vlessConn) Close() error {
+	c.writeMu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *vlessConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *vlessConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *vlessConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.ws.SetReadDeadline(t), c.ws.SetWriteDeadline(t))
+}
+func (c *vlessConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *vlessConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
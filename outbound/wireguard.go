@@ -0,0 +1,238 @@
+package outbound
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/unchainese/unchain/routing"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const wireGuardMTU = 1420
+
+// wireGuard relays through a WireGuard peer with a userspace netstack, the host interfaces and routes are not touched.
+// The device is brought up by the first dial and lives until Close.
+type wireGuard struct {
+	conf    routing.OutboundConfig
+	local   []netip.Addr
+	allowed []netip.Prefix
+	dns     []netip.Addr
+
+	mu     sync.Mutex
+	dev    *device.Device
+	tnet   *netstack.Net
+	closed bool
+}
+
+func newWireGuard(oc routing.OutboundConfig) (*wireGuard, error) {
+	w := &wireGuard{conf: oc}
+	for _, s := range oc.Address {
+		s = strings.TrimSpace(s)
+		if p, err := netip.ParsePrefix(s); err == nil {
+			w.local = append(w.local, p.Addr())
+			continue
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("outbound %q: invalid address %q", oc.Tag, s)
+		}
+		w.local = append(w.local, ip)
+	}
+	allowed := oc.AllowedIPs
+	if len(allowed) == 0 {
+		allowed = []string{"0.0.0.0/0", "::/0"}
+	}
+	var err error
+	if w.allowed, err = routing.ParsePrefixes(allowed); err != nil {
+		return nil, fmt.Errorf("outbound %q: %w", oc.Tag, err)
+	}
+	for _, s := range oc.DNS {
+		ip, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("outbound %q: invalid dns %q", oc.Tag, s)
+		}
+		w.dns = append(w.dns, ip)
+	}
+	return w, nil
+}
+
+// ipc is the device configuration in the wireguard uapi format, keys in hex.
+func (w *wireGuard) ipc(endpoint netip.AddrPort) (string, error) {
+	var b strings.Builder
+	for _, k := range []struct{ name, value string }{
+		{"private_key", w.conf.PrivateKey},
+		{"public_key", w.conf.PeerPublicKey},
+		{"preshared_key", w.conf.PresharedKey},
+	} {
+		if k.value == "" && k.name == "preshared_key" {
+			continue
+		}
+		key, err := routing.ParseKey(k.value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", k.name, err)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", k.name, hex.EncodeToString(key))
+	}
+	fmt.Fprintf(&b, "endpoint=%s\n", endpoint)
+	if w.conf.Keepalive > 0 {
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", w.conf.Keepalive)
+	}
+	for _, p := range w.allowed {
+		fmt.Fprintf(&b, "allowed_ip=%s\n", p)
+	}
+	return b.String(), nil
+}
+
+// up starts the device, the endpoint is resolved once.
+func (w *wireGuard) up(ctx context.Context) (*netstack.Net, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, net.ErrClosed
+	}
+	if w.tnet != nil {
+		return w.tnet, nil
+	}
+	host, port, err := net.SplitHostPort(w.conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", w.conf.Endpoint, err)
+	}
+	endpoint, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving endpoint: %w", err)
+	}
+	ap, err := netip.ParseAddrPort(net.JoinHostPort(endpoint[0].Unmap().String(), port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", w.conf.Endpoint, err)
+	}
+	ipc, err := w.ipc(ap)
+	if err != nil {
+		return nil, err
+	}
+	mtu := w.conf.MTU
+	if mtu == 0 {
+		mtu = wireGuardMTU
+	}
+	tun, tnet, err := netstack.CreateNetTUN(w.local, w.dns, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("creating netstack: %w", err)
+	}
+	tag := w.conf.Tag
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) { slog.Debug(fmt.Sprintf(format, args...), "outbound", tag) },
+		Errorf:   func(format string, args ...any) { slog.Warn(fmt.Sprintf(format, args...), "outbound", tag) },
+	})
+	if err := dev.IpcSet(ipc); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("configuring wireguard: %w", err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("starting wireguard: %w", err)
+	}
+	slog.Info("wireguard outbound up", "outbound", tag, "endpoint", ap)
+	w.dev, w.tnet = dev, tnet
+	return tnet, nil
+}
+
+// lookup resolves the destination with the tunnel resolvers when set, on the node otherwise.
+func (w *wireGuard) lookup(ctx context.Context, tnet *netstack.Net, host string) ([]netip.Addr, error) {
+	host = strings.Trim(host, "[]")
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	if len(w.dns) == 0 {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		for i := range ips {
+			ips[i] = ips[i].Unmap()
+		}
+		return ips, err
+	}
+	addrs, err := tnet.LookupContextHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		if ip, err := netip.ParseAddr(a); err == nil {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
+
+// routes reports whether ip goes through the peer and the tunnel has an address of its family.
+func (w *wireGuard) routes(ip netip.Addr) bool {
+	family := false
+	for _, l := range w.local {
+		family = family || l.Is4() == ip.Is4()
+	}
+	if !family {
+		return false
+	}
+	for _, p := range w.allowed {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *wireGuard) Dial(ctx context.Context, req *Request) (net.Conn, error) {
+	if req.Network != "tcp" && req.Network != "udp" {
+		return nil, ErrUnsupported
+	}
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	tnet, err := w.up(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard %s: %w", w.conf.Endpoint, err)
+	}
+	ips, err := w.lookup(ctx, tnet, req.Host)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard resolving %s: %w", req.Host, err)
+	}
+	errs := make([]error, 0)
+	for _, ip := range ips {
+		if !w.routes(ip) {
+			errs = append(errs, fmt.Errorf("%s is not routed through the tunnel", ip))
+			continue
+		}
+		ap := netip.AddrPortFrom(ip, req.Port)
+		var c net.Conn
+		if req.Network == "tcp" {
+			c, err = tnet.DialContextTCPAddrPort(ctx, ap)
+		} else {
+			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, ap)
+		}
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("no address for %s", req.Host))
+	}
+	return nil, fmt.Errorf("wireguard connecting to %s: %w", req.Addr(), errors.Join(errs...))
+}
+
+// Close stops the device, the connections through it are closed.
+func (w *wireGuard) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.dev != nil {
+		w.dev.Close()
+		w.dev, w.tnet = nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unchainese/unchain/routing"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// startPeer brings up a second netstack device as the WireGuard peer at 10.9.0.1 with TCP and UDP echo servers,
+// it returns the UDP endpoint of the peer.
+func startPeer(t *testing.T, key *ecdh.PrivateKey, client *ecdh.PublicKey) string {
+	peerIP := netip.MustParseAddr("10.9.0.1")
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{peerIP}, nil, wireGuardMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+	ipc := fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nallowed_ip=10.9.0.2/32\n",
+		hex.EncodeToString(key.Bytes()), hex.EncodeToString(client.Bytes()))
+	if err := dev.IpcSet(ipc); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ""
+	for _, line := range strings.Split(state, "\n") {
+		if v, ok := strings.CutPrefix(line, "listen_port="); ok {
+			port = v
+		}
+	}
+	if port == "" {
+		t.Fatalf("no listen port in %q", state)
+	}
+
+	ln, err := tnet.ListenTCP(&net.TCPAddr{IP: peerIP.AsSlice(), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	pc, err := tnet.ListenUDP(&net.UDPAddr{IP: peerIP.AsSlice(), Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+func echo(t *testing.T, c net.Conn, msg []byte) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestWireGuardDial(t *testing.T) {
+	clientKey, peerKey := newKey(t), newKey(t)
+	endpoint := startPeer(t, peerKey, clientKey.PublicKey())
+	w, err := newWireGuard(routing.OutboundConfig{
+		Tag:           "wg",
+		Type:          routing.OutboundWireGuard,
+		PrivateKey:    base64.StdEncoding.EncodeToString(clientKey.Bytes()),
+		PeerPublicKey: base64.StdEncoding.EncodeToString(peerKey.PublicKey().Bytes()),
+		Endpoint:      endpoint,
+		Address:       []string{"10.9.0.2/32"},
+		AllowedIPs:    []string{"10.9.0.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ctx := context.Background()
+
+	c, err := w.Dial(ctx, &Request{Network: "tcp", Host: "10.9.0.1", Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, []byte("hello over tcp"))
+	c.Close()
+
+	u, err := w.Dial(ctx, &Request{Network: "udp", Host: "10.9.0.1", Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, u, []byte("hello over udp"))
+	u.Close()
+
+	if _, err := w.Dial(ctx, &Request{Network: "tcp", Host: "192.0.2.1", Port: 80}); err == nil {
+		t.Error("dialing outside allowed_ips succeeded")
+	}
+	w.Close()
+	if _, err := w.Dial(ctx, &Request{Network: "tcp", Host: "10.9.0.1", Port: 80}); err == nil {
+		t.Error("dialing a closed tunnel succeeded")
+	}
+}
@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParsePrefixes parses CIDRs, a bare IP is a single address prefix.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	res := make([]netip.Prefix, 0, len(cidrs))
+	for _, v := range cidrs {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q", v)
+			}
+			res = append(res, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", v)
+		}
+		res = append(res, p.Masked())
+	}
+	return res, nil
+}
+
+type portRange struct{ lo, hi uint16 }
+
+// PortRanges is a set of ports like "25,6000-7000".
+type PortRanges []portRange
+
+// ParsePorts parses "25,6000-7000".
+func ParsePorts(s string) (PortRanges, error) {
+	res := make(PortRanges, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(v, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		h, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err1 != nil || err2 != nil || l > h {
+			return nil, fmt.Errorf("invalid port range %q", v)
+		}
+		res = append(res, portRange{uint16(l), uint16(h)})
+	}
+	return res, nil
+}
+
+func (r PortRanges) Contains(port uint16) bool {
+	for _, pr := range r {
+		if pr.lo <= port && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/unchainese/unchain/schema"
+)
+
+// built in outbounds, they need no [[outbound]] entry
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// Config is the routing file, rules are evaluated in order and the first match decides the outbound.
+type Config struct {
+	Default        string           `toml:"default"`         //outbound of the sessions no rule matches, direct when empty
+	ResolveDomains bool             `toml:"resolve_domains"` //resolve domain destinations to match ip rules
+	GeoDir         string           `toml:"geo_dir"`         //directory of geosite.dat, geoip.dat and the list files, relative to the routing file
+	Outbounds      []OutboundConfig `toml:"outbound"`
+	Rules          []RuleConfig     `toml:"rule"`
+
+	dir string //directory of the routing file
+}
+
+func (c *Config) geoDir() string {
+	if filepath.IsAbs(c.GeoDir) {
+		return c.GeoDir
+	}
+	return filepath.Join(c.dir, c.GeoDir)
+}
+
+// outbound types
+const (
+	OutboundSOCKS5 = "socks5"
+	OutboundHTTP   = "http"  //HTTP CONNECT proxy
+	OutboundVLESS  = "vless" //VLESS over WebSocket to another unchain or Xray node
+	OutboundGroup  = "group" //several outbounds picked by a strategy
+
+	OutboundWireGuard = "wireguard" //userspace WireGuard tunnel, no host interface or route
+	OutboundIPPool    = "ip-pool"   //direct from a source address picked out of a pool of local addresses
+)
+
+// group strategies
+const (
+	StrategyRoundRobin   = "round-robin"
+	StrategyRandom       = "random"
+	StrategyLeastConn    = "least-conn"
+	StrategyLeastLatency = "least-latency"
+	StrategyFallback     = "fallback" //the first healthy member in order
+)
+
+// ip pool strategies
+const (
+	StrategyStickyUser        = "sticky-user"        //a user keeps its address
+	StrategyStickyDestination = "sticky-destination" //a destination host keeps its address
+	StrategyRotate            = "rotate"             //the next address for every connection
+)
+
+// OutboundConfig is a named outbound.
+type OutboundConfig struct {
+	Tag      string `toml:"tag"`
+	Type     string `toml:"type"`     //direct, block, socks5, http, vless, wireguard, ip-pool or group
+	Server   string `toml:"server"`   //host:port of the upstream proxy
+	Username string `toml:"username"` //optional proxy credentials
+	Password string `toml:"password"`
+	UUID     string `toml:"uuid"`     //vless user
+	Path     string `toml:"path"`     //vless WebSocket path, like /wsv/<uuid>?ed=2560
+	Host     string `toml:"host"`     //vless Host header, for a CDN in front of the server
+	TLS      bool   `toml:"tls"`      //vless over wss
+	SNI      string `toml:"sni"`      //TLS server name, the Host or the server host when empty
+	Insecure bool   `toml:"insecure"` //skip the certificate verification
+
+	PrivateKey    string   `toml:"private_key"`     //wireguard key of the node, base64 as wg genkey prints it
+	PeerPublicKey string   `toml:"peer_public_key"` //base64
+	PresharedKey  string   `toml:"preshared_key"`   //optional, base64
+	Endpoint      string   `toml:"endpoint"`        //wireguard peer host:port
+	Address       []string `toml:"address"`         //tunnel addresses of the node, like 172.16.0.2/32 or fd01::2/128
+	AllowedIPs    []string `toml:"allowed_ips"`     //destinations sent to the peer, 0.0.0.0/0 and ::/0 when empty
+	DNS           []string `toml:"dns"`             //resolvers inside the tunnel, domains are resolved on the node when empty
+	MTU           int      `toml:"mtu"`             //1420 when 0
+	Keepalive     int      `toml:"keepalive"`       //persistent keepalive seconds, 0 disables it
+
+	SockOpt schema.SockOpt `toml:"sockopt"` //socket options of a direct or ip pool outbound
+
+	Addresses []string `toml:"addresses"`  //ip pool source addresses or CIDRs, all assigned to the node
+	StickyTTL int      `toml:"sticky_ttl"` //seconds an unused sticky address is kept, 600 when 0
+
+	Members       []string `toml:"members"`        //group members, outbounds that are not groups
+	Strategy      string   `toml:"strategy"`       //group strategy, round-robin when empty, or ip pool strategy, sticky-user when empty
+	Probe         string   `toml:"probe"`          //group health probe, an http(s):// URL or tcp://host:port
+	ProbeInterval int      `toml:"probe_interval"` //seconds between probes, 60 when 0
+}
+
+// RuleConfig matches a session when all its non empty fields match,
+// a field with several values matches when any of them does.
+type RuleConfig struct {
+	Domain   []string `toml:"domain"`   //full:, suffix: (domain:), keyword: or regexp: prefixed, a bare domain is a suffix, or geosite:, ext:, list:
+	IP       []string `toml:"ip"`       //destination CIDRs, or geoip:, ext:, list:
+	Port     string   `toml:"port"`     //destination ports like "80,443,1000-2000"
+	Network  string   `toml:"network"`  //tcp, udp or "tcp,udp"
+	User     []string `toml:"user"`     //user UUIDs
+	Inbound  []string `toml:"inbound"`  //inbound protocols, vless
+	Protocol []string `toml:"protocol"` //sniffed protocols: tls, http, bittorrent, smtp
+	Outbound string   `toml:"outbound"`
+
+	RateLimit int `toml:"rate_limit"` //KB/s each direction, shared by the sessions of a user the rule matches, 0 unlimited
+}
+
+// LoadFile reads a routing file, unknown keys are errors so a typo does not silently disable a rule.
+func LoadFile(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading routing file %s: %w", file, err)
+	}
+	c, err := Parse(string(data), filepath.Dir(file))
+	if err != nil {
+		return nil, fmt.Errorf("routing file %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// Parse decodes rules in the routing file format, relative geo and list paths are in dir.
+func Parse(data, dir string) (*Config, error) {
+	c := &Config{dir: dir}
+	md, err := toml.Decode(data, c)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+	return c, nil
+}
@@ -0,0 +1,215 @@
+package routing
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// default files of the geosite: and geoip: references, the v2ray/Xray data files
+const (
+	geoSiteFile = "geosite.dat"
+	geoIPFile   = "geoip.dat"
+)
+
+// geo domain types of the v2ray dat format
+const (
+	geoDomainPlain  = 0 //keyword
+	geoDomainRegex  = 1
+	geoDomainSuffix = 2
+	geoDomainFull   = 3
+)
+
+// geoLoader reads the list files a routing config refers to, each file is read once per load
+// and only the entries of the referenced codes are decoded.
+type geoLoader struct {
+	dir   string
+	sites map[string]map[string][]byte //file -> code -> GeoSite message
+	ips   map[string]map[string][]byte //file -> code -> GeoIP message
+}
+
+func newGeoLoader(dir string) *geoLoader {
+	return &geoLoader{dir: dir, sites: make(map[string]map[string][]byte), ips: make(map[string]map[string][]byte)}
+}
+
+func (l *geoLoader) path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(l.dir, file)
+}
+
+// readDat indexes the entries of a GeoSiteList or GeoIPList by their upper case country code.
+func (l *geoLoader) readDat(file string) (map[string][]byte, error) {
+	data, err := os.ReadFile(l.path(file))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	err = protoFields(data, func(f protoField) error {
+		if f.num != 1 || f.bytes == nil {
+			return nil
+		}
+		code := ""
+		err := protoFields(f.bytes, func(ef protoField) error {
+			if ef.num == 1 {
+				code = strings.ToUpper(string(ef.bytes))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		res[code] = f.bytes
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", file, err)
+	}
+	return res, nil
+}
+
+func (l *geoLoader) entry(cache map[string]map[string][]byte, file, code string) ([]byte, error) {
+	codes, ok := cache[file]
+	if !ok {
+		var err error
+		if codes, err = l.readDat(file); err != nil {
+			return nil, err
+		}
+		cache[file] = codes
+	}
+	msg, ok := codes[strings.ToUpper(code)]
+	if !ok {
+		return nil, fmt.Errorf("%s has no %q list", file, code)
+	}
+	return msg, nil
+}
+
+// siteDomains returns the domain rules of a geosite code, with an attribute only the domains that carry it.
+func (l *geoLoader) siteDomains(file, code, attr string) ([]string, error) {
+	msg, err := l.entry(l.sites, file, code)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	err = protoFields(msg, func(f protoField) error {
+		if f.num != 2 {
+			return nil
+		}
+		var typ uint64
+		var value string
+		hasAttr := attr == ""
+		err := protoFields(f.bytes, func(df protoField) error {
+			switch df.num {
+			case 1:
+				typ = df.varint
+			case 2:
+				value = string(df.bytes)
+			case 3:
+				return protoFields(df.bytes, func(af protoField) error {
+					if af.num == 1 && strings.EqualFold(string(af.bytes), attr) {
+						hasAttr = true
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil || !hasAttr {
+			return err
+		}
+		switch typ {
+		case geoDomainPlain:
+			res = append(res, "keyword:"+value)
+		case geoDomainRegex:
+			res = append(res, "regexp:"+value)
+		case geoDomainSuffix:
+			res = append(res, "suffix:"+value)
+		case geoDomainFull:
+			res = append(res, "full:"+value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s %s: %w", file, code, err)
+	}
+	return res, nil
+}
+
+// ipPrefixes returns the CIDRs of a geoip code and if the list is meant reversed.
+func (l *geoLoader) ipPrefixes(file, code string) ([]netip.Prefix, bool, error) {
+	msg, err := l.entry(l.ips, file, code)
+	if err != nil {
+		return nil, false, err
+	}
+	res := make([]netip.Prefix, 0)
+	reverse := false
+	err = protoFields(msg, func(f protoField) error {
+		switch f.num {
+		case 3:
+			reverse = f.varint != 0
+		case 2:
+			var ip []byte
+			var bits uint64
+			err := protoFields(f.bytes, func(cf protoField) error {
+				switch cf.num {
+				case 1:
+					ip = cf.bytes
+				case 2:
+					bits = cf.varint
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok || int(bits) > addr.BitLen() {
+				return errProtobuf
+			}
+			res = append(res, netip.PrefixFrom(addr, int(bits)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding %s %s: %w", file, code, err)
+	}
+	return res, reverse, nil
+}
+
+// lines reads a plain list file, one entry per line, empty lines and # comments are skipped.
+func (l *geoLoader) lines(file string) ([]string, error) {
+	f, err := os.Open(l.path(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res, sc.Err()
+}
+
+// splitGeoRef splits "geosite:google@ads" or "ext:file.dat:google@ads" into file, code and attribute.
+func splitGeoRef(kind, value, defaultFile string) (file, code, attr string, err error) {
+	file = defaultFile
+	if kind == "ext" {
+		var ok bool
+		if file, value, ok = strings.Cut(value, ":"); !ok {
+			return "", "", "", fmt.Errorf("ext rule %q needs a file and a code", value)
+		}
+	}
+	code, attr, _ = strings.Cut(value, "@")
+	if code == "" {
+		return "", "", "", fmt.Errorf("empty %s code", kind)
+	}
+	return file, code, attr, nil
+}
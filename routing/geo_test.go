@@ -0,0 +1,148 @@
+package routing
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// geoDomain encodes a Domain message of the geosite format.
+func geoDomain(typ uint64, value string, attrs ...string) []byte {
+	b := concat(protoVarint(1, typ), protoBytes(2, []byte(value)))
+	for _, a := range attrs {
+		b = append(b, protoBytes(3, concat(protoBytes(1, []byte(a)), protoVarint(2, 1)))...)
+	}
+	return b
+}
+
+func geoCIDR(s string) []byte {
+	p := netip.MustParsePrefix(s)
+	return protoBytes(2, concat(protoBytes(1, p.Addr().AsSlice()), protoVarint(2, uint64(p.Bits()))))
+}
+
+// writeGeoFiles writes a small geosite.dat, geoip.dat and plain lists into a temporary directory.
+func writeGeoFiles(t *testing.T) string {
+	dir := t.TempDir()
+	google := concat(
+		protoBytes(1, []byte("GOOGLE")),
+		protoBytes(2, geoDomain(geoDomainSuffix, "google.com")),
+		protoBytes(2, geoDomain(geoDomainSuffix, "googleadservices.com", "ads")),
+		protoBytes(2, geoDomain(geoDomainFull, "ads.google.com", "ads", "cn")),
+		protoBytes(2, geoDomain(geoDomainPlain, "googleapis")),
+		protoBytes(2, geoDomain(geoDomainRegex, `^gtrack[0-9]+\.`)),
+	)
+	cn := concat(protoBytes(1, []byte("cn")), geoCIDR("1.0.1.0/24"), geoCIDR("240e::/18"))
+	files := map[string][]byte{
+		"geosite.dat": concat(protoBytes(1, google), protoBytes(1, protoBytes(1, []byte("EMPTY")))),
+		"geoip.dat":   concat(protoBytes(1, cn), protoBytes(1, protoBytes(1, []byte("EMPTY")))),
+		"domains.txt": []byte("# my list\nexample.org\nfull:only.example.net # inline\n\n"),
+		"empty.txt":   []byte("# nothing yet\n\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSiteDomains(t *testing.T) {
+	l := newGeoLoader(writeGeoFiles(t))
+	tests := []struct {
+		code, attr string
+		want       []string
+	}{
+		{"google", "", []string{"suffix:google.com", "suffix:googleadservices.com", "full:ads.google.com", "keyword:googleapis", `regexp:^gtrack[0-9]+\.`}},
+		{"GOOGLE", "ads", []string{"suffix:googleadservices.com", "full:ads.google.com"}},
+		{"google", "CN", []string{"full:ads.google.com"}},
+		{"google", "nope", []string{}},
+		{"empty", "", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := l.siteDomains(geoSiteFile, tt.code, tt.attr)
+		if err != nil {
+			t.Errorf("siteDomains(%s@%s): %v", tt.code, tt.attr, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("siteDomains(%s@%s) = %q, want %q", tt.code, tt.attr, got, tt.want)
+		}
+	}
+	if _, err := l.siteDomains(geoSiteFile, "missing", ""); err == nil {
+		t.Error("siteDomains of a missing code must fail")
+	}
+}
+
+func TestIPPrefixes(t *testing.T) {
+	l := newGeoLoader(writeGeoFiles(t))
+	got, reverse, err := l.ipPrefixes(geoIPFile, "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("1.0.1.0/24"), netip.MustParsePrefix("240e::/18")}
+	if !slices.Equal(got, want) || reverse {
+		t.Errorf("ipPrefixes(cn) = %v %v, want %v false", got, reverse, want)
+	}
+}
+
+func TestGeoReferences(t *testing.T) {
+	dir := writeGeoFiles(t)
+	tests := []struct {
+		name    string
+		rule    RuleConfig
+		wantErr string
+	}{
+		{"geosite", RuleConfig{Domain: []string{"geosite:google"}}, ""},
+		{"geosite attribute", RuleConfig{Domain: []string{"geosite:google@ads"}}, ""},
+		{"domain list", RuleConfig{Domain: []string{"list:domains.txt"}}, ""},
+		{"geoip", RuleConfig{IP: []string{"geoip:cn"}}, ""},
+		{"filtered to nothing", RuleConfig{Domain: []string{"geosite:google@nope"}}, "no domains"},
+		{"empty geosite", RuleConfig{Domain: []string{"geosite:empty"}}, "no domains"},
+		{"empty domain list", RuleConfig{Domain: []string{"list:empty.txt"}}, "no domains"},
+		{"empty geoip", RuleConfig{IP: []string{"geoip:empty"}}, "no cidrs"},
+		{"empty ip list", RuleConfig{IP: []string{"list:empty.txt"}}, "no cidrs"},
+		{"missing code", RuleConfig{Domain: []string{"geosite:missing"}}, "no \"missing\" list"},
+	}
+	for _, tt := range tests {
+		tt.rule.Outbound = OutboundBlock
+		_, err := New(&Config{GeoDir: dir, Rules: []RuleConfig{tt.rule}})
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGeoRoute(t *testing.T) {
+	r, err := New(&Config{GeoDir: writeGeoFiles(t), Rules: []RuleConfig{
+		{Domain: []string{"geosite:google@ads", "list:domains.txt"}, Outbound: OutboundBlock},
+		{IP: []string{"geoip:cn"}, Outbound: OutboundBlock},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.googleadservices.com", OutboundBlock},
+		{"ads.google.com", OutboundBlock},
+		{"google.com", OutboundDirect}, //not tagged ads
+		{"sub.example.org", OutboundBlock},
+		{"only.example.net", OutboundBlock},
+		{"x.only.example.net", OutboundDirect},
+		{"1.0.1.5", OutboundBlock},
+		{"240e::1", OutboundBlock},
+		{"8.8.8.8", OutboundDirect},
+	}
+	for _, tt := range tests {
+		if got, _ := r.Route(&Metadata{Network: "tcp", Host: tt.host, Port: 443}); got != tt.want {
+			t.Errorf("Route(%s) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package routing
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// normalizeDomain lower cases the domain and drops the trailing dot of a FQDN.
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// domainMatcher matches a domain against full names, suffixes, keywords and regular expressions.
+type domainMatcher struct {
+	full    map[string]bool
+	suffix  suffixTrie
+	keyword []string
+	regexp  []*regexp.Regexp
+	empty   bool
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{full: make(map[string]bool), empty: true}
+}
+
+// add adds a "full:", "suffix:" or "domain:", "keyword:" or "regexp:" entry, a bare domain is a suffix.
+// "geosite:code[@attr]" and "ext:file.dat:code[@attr]" add a list of a v2ray dat file,
+// "list:file.txt" a plain file of entries, l is nil inside a plain file.
+func (m *domainMatcher) add(entry string, l *geoLoader) error {
+	kind, value, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok {
+		kind, value = "suffix", kind
+	}
+	switch kind {
+	case "geosite", "ext", "list":
+		if l == nil {
+			return fmt.Errorf("%s rule %q not allowed in a list file", kind, entry)
+		}
+		return m.addList(kind, value, l)
+	case "regexp", "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid domain regexp %q: %w", value, err)
+		}
+		m.regexp = append(m.regexp, re)
+		m.empty = false
+		return nil
+	}
+	if value = normalizeDomain(value); value == "" {
+		return fmt.Errorf("empty domain rule %q", entry)
+	}
+	switch kind {
+	case "full":
+		m.full[value] = true
+	case "suffix", "domain":
+		m.suffix.add(value)
+	case "keyword":
+		m.keyword = append(m.keyword, value)
+	default:
+		return fmt.Errorf("unknown domain rule type %q", kind)
+	}
+	m.empty = false
+	return nil
+}
+
+func (m *domainMatcher) addList(kind, value string, l *geoLoader) error {
+	var entries []string
+	var err error
+	if kind == "list" {
+		entries, err = l.lines(value)
+	} else {
+		var file, code, attr string
+		if file, code, attr, err = splitGeoRef(kind, value, geoSiteFile); err == nil {
+			entries, err = l.siteDomains(file, code, attr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("domain rule %s:%s: %w", kind, value, err)
+	}
+	// an empty list would leave the matcher empty and the rule would match every domain
+	if len(entries) == 0 {
+		return fmt.Errorf("domain rule %s:%s: no domains", kind, value)
+	}
+	m.empty = false
+	for _, e := range entries {
+		if err := m.add(e, nil); err != nil {
+			return fmt.Errorf("domain rule %s:%s: %w", kind, value, err)
+		}
+	}
+	return nil
+}
+
+// match reports if the normalized domain matches, a suffix matches the domain itself and its subdomains.
+func (m *domainMatcher) match(domain string) bool {
+	if m.full[domain] || m.suffix.match(domain) {
+		return true
+	}
+	for _, k := range m.keyword {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range m.regexp {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipMatcher matches addresses against CIDRs, a reversed list matches the addresses outside of it.
+type ipMatcher struct {
+	tree     cidrTree
+	reversed []*cidrTree
+	empty    bool
+}
+
+func newIPMatcher() *ipMatcher {
+	return &ipMatcher{empty: true}
+}
+
+// add adds a CIDR or IP, "geoip:code" and "ext:file.dat:code" add a list of a v2ray dat file,
+// "geoip:!code" the addresses outside of it, "list:file.txt" a plain file of CIDRs.
+func (m *ipMatcher) add(entry string, l *geoLoader) error {
+	kind, value, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok || (kind != "geoip" && kind != "ext" && kind != "list") {
+		p, err := ParsePrefixes([]string{entry})
+		if err != nil {
+			return err
+		}
+		for _, v := range p {
+			m.tree.add(v)
+		}
+		m.empty = m.empty && len(p) == 0
+		return nil
+	}
+	if kind == "list" {
+		lines, err := l.lines(value)
+		if err != nil {
+			return fmt.Errorf("ip rule %s: %w", entry, err)
+		}
+		p, err := ParsePrefixes(lines)
+		if err != nil {
+			return fmt.Errorf("ip rule %s: %w", entry, err)
+		}
+		if len(p) == 0 {
+			return fmt.Errorf("ip rule %s: no cidrs", entry)
+		}
+		for _, v := range p {
+			m.tree.add(v)
+		}
+		m.empty = false
+		return nil
+	}
+	not := false
+	if kind == "geoip" {
+		value, not = strings.CutPrefix(value, "!")
+	}
+	file, code, _, err := splitGeoRef(kind, value, geoIPFile)
+	if err != nil {
+		return err
+	}
+	prefixes, reverse, err := l.ipPrefixes(file, code)
+	if err != nil {
+		return fmt.Errorf("ip rule %s: %w", entry, err)
+	}
+	if len(prefixes) == 0 {
+		return fmt.Errorf("ip rule %s: no cidrs", entry)
+	}
+	t := &m.tree
+	if not != reverse {
+		t = &cidrTree{}
+		m.reversed = append(m.reversed, t)
+	}
+	for _, p := range prefixes {
+		t.add(p)
+	}
+	m.empty = false
+	return nil
+}
+
+func (m *ipMatcher) match(ip netip.Addr) bool {
+	if m.tree.match(ip) {
+		return true
+	}
+	for _, t := range m.reversed {
+		if !t.match(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errProtobuf = errors.New("malformed protobuf")
+
+// protoField is one field of a protobuf message, only the wire types the geo files use are kept.
+type protoField struct {
+	num    uint64
+	varint uint64
+	bytes  []byte //length delimited value
+}
+
+// protoFields walks the fields of a protobuf message, fn returning an error stops the walk.
+func protoFields(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtobuf
+		}
+		b = b[n:]
+		f := protoField{num: key >> 3}
+		switch key & 7 {
+		case 0: //varint
+			if f.varint, n = binary.Uvarint(b); n <= 0 {
+				return errProtobuf
+			}
+			b = b[n:]
+		case 1: //64 bit
+			if len(b) < 8 {
+				return errProtobuf
+			}
+			b = b[8:]
+			continue
+		case 2: //length delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtobuf
+			}
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5: //32 bit
+			if len(b) < 4 {
+				return errProtobuf
+			}
+			b = b[4:]
+			continue
+		default:
+			return errProtobuf
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
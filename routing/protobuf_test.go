@@ -0,0 +1,91 @@
+package routing
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// protobuf encoding helpers of the tests
+func protoKey(num, wireType int) []byte {
+	return binary.AppendUvarint(nil, uint64(num<<3|wireType))
+}
+
+func protoBytes(num int, b []byte) []byte {
+	res := binary.AppendUvarint(protoKey(num, 2), uint64(len(b)))
+	return append(res, b...)
+}
+
+func protoVarint(num int, v uint64) []byte {
+	return binary.AppendUvarint(protoKey(num, 0), v)
+}
+
+func concat(parts ...[]byte) []byte {
+	res := make([]byte, 0)
+	for _, p := range parts {
+		res = append(res, p...)
+	}
+	return res
+}
+
+func TestProtoFields(t *testing.T) {
+	msg := concat(
+		protoVarint(1, 300),
+		protoBytes(2, []byte("hello")),
+		append(protoKey(3, 1), make([]byte, 8)...), //fixed64 is skipped
+		append(protoKey(4, 5), make([]byte, 4)...), //fixed32 is skipped
+		protoBytes(5, nil),
+	)
+	got := make([]protoField, 0)
+	if err := protoFields(msg, func(f protoField) error {
+		got = append(got, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d fields, want 3", len(got))
+	}
+	if got[0].num != 1 || got[0].varint != 300 {
+		t.Errorf("field 1 = %+v", got[0])
+	}
+	if got[1].num != 2 || string(got[1].bytes) != "hello" {
+		t.Errorf("field 2 = %+v", got[1])
+	}
+	if got[2].num != 5 || len(got[2].bytes) != 0 {
+		t.Errorf("field 5 = %+v", got[2])
+	}
+}
+
+func TestProtoFieldsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"truncated key", []byte{0x80}},
+		{"truncated varint", append(protoKey(1, 0), 0x80)},
+		{"length past the end", append(protoKey(2, 2), 10, 'a')},
+		{"huge length", append(protoKey(2, 2), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+		{"short fixed64", append(protoKey(3, 1), 1, 2, 3)},
+		{"short fixed32", append(protoKey(3, 5), 1)},
+		{"group wire type", protoKey(3, 3)},
+	}
+	for _, tt := range tests {
+		err := protoFields(tt.msg, func(protoField) error { return nil })
+		if !errors.Is(err, errProtobuf) {
+			t.Errorf("%s: err = %v, want errProtobuf", tt.name, err)
+		}
+	}
+}
+
+func TestProtoFieldsStop(t *testing.T) {
+	stop := errors.New("stop")
+	n := 0
+	err := protoFields(concat(protoVarint(1, 1), protoVarint(2, 2)), func(protoField) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("err = %v after %d fields, want stop after 1", err, n)
+	}
+}
@@ -0,0 +1,368 @@
+package routing
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/unchainese/unchain/schema"
+)
+
+// Metadata describes a session for the rules.
+type Metadata struct {
+	Network     string //tcp or udp
+	Host        string //destination domain or IP as sent by the client
+	Port        uint16
+	User        string
+	Inbound     string
+	Protocol    string //sniffed protocol, empty when unknown
+	SniffedHost string //TLS SNI or HTTP Host of the first payload
+
+	// Lookup resolves a domain destination for the ip rules, only used when the routing file sets resolve_domains
+	Lookup func(host string) []netip.Addr
+
+	ips      []netip.Addr
+	resolved bool
+}
+
+// domains returns the destination domain and the sniffed host, the ones that are set.
+func (m *Metadata) domains() []string {
+	res := make([]string, 0, 2)
+	if _, err := netip.ParseAddr(strings.Trim(m.Host, "[]")); err != nil && m.Host != "" {
+		res = append(res, normalizeDomain(m.Host))
+	}
+	if h := normalizeDomain(m.SniffedHost); h != "" && (len(res) == 0 || res[0] != h) {
+		res = append(res, h)
+	}
+	return res
+}
+
+// destIPs returns the destination IP, or the resolved addresses of a domain when resolve is set.
+func (m *Metadata) destIPs(resolve bool) []netip.Addr {
+	if m.resolved {
+		return m.ips
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(m.Host, "[]")); err == nil {
+		m.ips, m.resolved = []netip.Addr{ip.Unmap()}, true
+		return m.ips
+	}
+	if !resolve || m.Lookup == nil {
+		return nil
+	}
+	m.ips, m.resolved = m.Lookup(m.Host), true
+	return m.ips
+}
+
+type rule struct {
+	domains   *domainMatcher
+	ips       *ipMatcher
+	ports     PortRanges
+	networks  map[string]bool
+	users     map[string]bool
+	inbounds  map[string]bool
+	protocols map[string]bool
+	outbound  string
+	rateLimit int
+}
+
+func stringSet(values []string) map[string]bool {
+	res := make(map[string]bool)
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			res[v] = true
+		}
+	}
+	return res
+}
+
+func compileRule(rc RuleConfig, l *geoLoader) (*rule, error) {
+	r := &rule{
+		domains:   newDomainMatcher(),
+		ips:       newIPMatcher(),
+		networks:  stringSet(strings.Split(rc.Network, ",")),
+		users:     stringSet(rc.User),
+		inbounds:  stringSet(rc.Inbound),
+		protocols: stringSet(rc.Protocol),
+		outbound:  strings.TrimSpace(rc.Outbound),
+		rateLimit: rc.RateLimit,
+	}
+	if rc.RateLimit < 0 {
+		return nil, fmt.Errorf("negative rate_limit")
+	}
+	for _, d := range rc.Domain {
+		if err := r.domains.add(d, l); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range rc.IP {
+		if err := r.ips.add(cidr, l); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if r.ports, err = ParsePorts(rc.Port); err != nil {
+		return nil, err
+	}
+	for n := range r.networks {
+		if n != "tcp" && n != "udp" {
+			return nil, fmt.Errorf("unknown network %q", n)
+		}
+	}
+	return r, nil
+}
+
+func (r *rule) match(m *Metadata, resolve bool) bool {
+	if len(r.networks) > 0 && !r.networks[m.Network] {
+		return false
+	}
+	if len(r.ports) > 0 && !r.ports.Contains(m.Port) {
+		return false
+	}
+	if len(r.users) > 0 && !r.users[m.User] {
+		return false
+	}
+	if len(r.inbounds) > 0 && !r.inbounds[m.Inbound] {
+		return false
+	}
+	if len(r.protocols) > 0 && !r.protocols[m.Protocol] {
+		return false
+	}
+	if !r.domains.empty && !r.matchDomain(m) {
+		return false
+	}
+	if !r.ips.empty && !r.matchIP(m, resolve) {
+		return false
+	}
+	return true
+}
+
+func (r *rule) matchDomain(m *Metadata) bool {
+	for _, d := range m.domains() {
+		if r.domains.match(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchIP(m *Metadata, resolve bool) bool {
+	for _, ip := range m.destIPs(resolve) {
+		if r.ips.match(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router picks the outbound of a session, it is immutable and safe for concurrent use.
+type Router struct {
+	rules     []*rule
+	def       string
+	resolve   bool
+	outbounds map[string]OutboundConfig
+}
+
+// New compiles the rules and checks every outbound they name exists.
+func New(c *Config) (*Router, error) {
+	r := &Router{
+		def:       OutboundDirect,
+		resolve:   c.ResolveDomains,
+		outbounds: map[string]OutboundConfig{OutboundDirect: {Tag: OutboundDirect, Type: OutboundDirect}, OutboundBlock: {Tag: OutboundBlock, Type: OutboundBlock}},
+	}
+	for _, oc := range c.Outbounds {
+		oc.Tag, oc.Type = strings.TrimSpace(oc.Tag), strings.ToLower(strings.TrimSpace(oc.Type))
+		if oc.Tag == "" {
+			return nil, fmt.Errorf("outbound without tag")
+		}
+		if _, ok := r.outbounds[oc.Tag]; ok {
+			return nil, fmt.Errorf("duplicate outbound %q", oc.Tag)
+		}
+		if err := checkOutbound(oc); err != nil {
+			return nil, fmt.Errorf("outbound %q: %w", oc.Tag, err)
+		}
+		r.outbounds[oc.Tag] = oc
+	}
+	for _, oc := range r.outbounds {
+		for _, m := range oc.Members {
+			mo, ok := r.outbounds[m]
+			if !ok {
+				return nil, fmt.Errorf("outbound %q: member %q is not defined", oc.Tag, m)
+			}
+			if mo.Type == OutboundGroup {
+				return nil, fmt.Errorf("outbound %q: member %q is a group", oc.Tag, m)
+			}
+		}
+	}
+	if d := strings.TrimSpace(c.Default); d != "" {
+		if _, ok := r.outbounds[d]; !ok {
+			return nil, fmt.Errorf("default outbound %q is not defined", d)
+		}
+		r.def = d
+	}
+	l := newGeoLoader(c.geoDir())
+	for i, rc := range c.Rules {
+		rl, err := compileRule(rc, l)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if _, ok := r.outbounds[rl.outbound]; !ok {
+			return nil, fmt.Errorf("rule %d: outbound %q is not defined", i+1, rl.outbound)
+		}
+		r.rules = append(r.rules, rl)
+	}
+	return r, nil
+}
+
+func checkOutbound(oc OutboundConfig) error {
+	if oc.SockOpt != (schema.SockOpt{}) && oc.Type != OutboundDirect && oc.Type != OutboundIPPool {
+		return fmt.Errorf("sockopt is only supported by direct and ip-pool outbounds")
+	}
+	switch oc.Type {
+	case OutboundDirect:
+		return CheckSockOpt(oc.SockOpt)
+	case OutboundBlock:
+		return nil
+	case OutboundSOCKS5, OutboundHTTP, OutboundVLESS:
+		if _, _, err := net.SplitHostPort(oc.Server); err != nil {
+			return fmt.Errorf("invalid server %q: %w", oc.Server, err)
+		}
+		if _, err := uuid.Parse(oc.UUID); oc.Type == OutboundVLESS && err != nil {
+			return fmt.Errorf("invalid uuid %q", oc.UUID)
+		}
+		return nil
+	case OutboundWireGuard:
+		return checkWireGuard(oc)
+	case OutboundIPPool:
+		if len(oc.Addresses) == 0 {
+			return fmt.Errorf("ip-pool without addresses")
+		}
+		if _, err := ParsePrefixes(oc.Addresses); err != nil {
+			return fmt.Errorf("addresses: %w", err)
+		}
+		switch oc.Strategy {
+		case "", StrategyStickyUser, StrategyStickyDestination, StrategyRotate:
+		default:
+			return fmt.Errorf("unknown strategy %q", oc.Strategy)
+		}
+		if oc.SockOpt.BindIP != "" {
+			return fmt.Errorf("the pool picks the source address, sockopt bind_ip is not allowed")
+		}
+		if oc.StickyTTL < 0 {
+			return fmt.Errorf("negative sticky_ttl")
+		}
+		return CheckSockOpt(oc.SockOpt)
+	case OutboundGroup:
+		if len(oc.Members) == 0 {
+			return fmt.Errorf("group without members")
+		}
+		switch oc.Strategy {
+		case "", StrategyRoundRobin, StrategyRandom, StrategyLeastConn, StrategyLeastLatency, StrategyFallback:
+		default:
+			return fmt.Errorf("unknown strategy %q", oc.Strategy)
+		}
+		if u, err := url.Parse(oc.Probe); oc.Probe != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tcp")) {
+			return fmt.Errorf("probe %q is not an http(s):// URL or tcp://host:port", oc.Probe)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown type %q", oc.Type)
+	}
+}
+
+// Route returns the outbound tag of the session and the 1 based number of the matching rule, 0 for the default.
+func (r *Router) Route(m *Metadata) (string, int) {
+	for i, rl := range r.rules {
+		if rl.match(m, r.resolve) {
+			return rl.outbound, i + 1
+		}
+	}
+	return r.def, 0
+}
+
+// Outbound returns the outbound of the tag, direct and block always exist.
+func (r *Router) Outbound(tag string) (OutboundConfig, bool) {
+	oc, ok := r.outbounds[tag]
+	return oc, ok
+}
+
+// Outbounds returns all the outbounds, the built in ones included.
+func (r *Router) Outbounds() []OutboundConfig {
+	res := make([]OutboundConfig, 0, len(r.outbounds))
+	for _, oc := range r.outbounds {
+		res = append(res, oc)
+	}
+	return res
+}
+
+// RateLimit returns the KB/s limit of the 1 based rule, 0 for unlimited or the default.
+func (r *Router) RateLimit(rule int) int {
+	if rule < 1 || rule > len(r.rules) {
+		return 0
+	}
+	return r.rules[rule-1].rateLimit
+}
+
+// Rules returns how many rules the router has.
+func (r *Router) Rules() int {
+	return len(r.rules)
+}
+
+func checkWireGuard(oc OutboundConfig) error {
+	if _, err := ParseKey(oc.PrivateKey); err != nil {
+		return fmt.Errorf("private_key: %w", err)
+	}
+	if _, err := ParseKey(oc.PeerPublicKey); err != nil {
+		return fmt.Errorf("peer_public_key: %w", err)
+	}
+	if _, err := ParseKey(oc.PresharedKey); oc.PresharedKey != "" && err != nil {
+		return fmt.Errorf("preshared_key: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(oc.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", oc.Endpoint, err)
+	}
+	if len(oc.Address) == 0 {
+		return fmt.Errorf("wireguard without address")
+	}
+	if _, err := ParsePrefixes(oc.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if _, err := ParsePrefixes(oc.AllowedIPs); err != nil {
+		return fmt.Errorf("allowed_ips: %w", err)
+	}
+	for _, s := range oc.DNS {
+		if _, err := netip.ParseAddr(s); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	if oc.MTU < 0 || oc.Keepalive < 0 {
+		return fmt.Errorf("negative mtu or keepalive")
+	}
+	return nil
+}
+
+// CheckSockOpt validates the socket options of the direct connections.
+func CheckSockOpt(o schema.SockOpt) error {
+	if _, err := netip.ParseAddr(o.BindIP); o.BindIP != "" && err != nil {
+		return fmt.Errorf("invalid bind_ip %q", o.BindIP)
+	}
+	if o.Mark < 0 {
+		return fmt.Errorf("invalid mark %d", o.Mark)
+	}
+	if o.KeepAlive < -1 {
+		return fmt.Errorf("invalid tcp_keepalive %d, -1 disables it", o.KeepAlive)
+	}
+	return nil
+}
+
+// ParseKey decodes a base64 WireGuard key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid key, want 32 bytes in base64")
+	}
+	return key, nil
+}
@@ -0,0 +1,183 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// sniffed protocols
+const (
+	ProtocolTLS        = "tls"
+	ProtocolHTTP       = "http"
+	ProtocolBitTorrent = "bittorrent" //peer wire handshake, DHT, uTP or UDP tracker
+	ProtocolSMTP       = "smtp"       //port 25 or a client greeting
+)
+
+const smtpPort = 25
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Sniff guesses the protocol of the first payload of a session to port and the host it names, if any.
+func Sniff(network string, port uint16, payload []byte) (protocol, host string) {
+	if network == "udp" {
+		if sniffBitTorrentUDP(port, payload) {
+			return ProtocolBitTorrent, ""
+		}
+		return "", ""
+	}
+	if network != "tcp" {
+		return "", ""
+	}
+	if host, ok := sniffTLS(payload); ok {
+		return ProtocolTLS, host
+	}
+	if host, ok := sniffHTTP(payload); ok {
+		return ProtocolHTTP, host
+	}
+	if len(payload) >= 20 && payload[0] == 19 && bytes.HasPrefix(payload[1:], []byte("BitTorrent protocol")) {
+		return ProtocolBitTorrent, ""
+	}
+	// the server speaks first, a client payload is only there when the client does not wait for the greeting
+	if port == smtpPort || hasPrefixFold(payload, "EHLO ") || hasPrefixFold(payload, "HELO ") {
+		return ProtocolSMTP, ""
+	}
+	return "", ""
+}
+
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && strings.EqualFold(string(b[:len(prefix)]), prefix)
+}
+
+// udpTrackerMagic is the protocol id of a UDP tracker connect request, BEP 15.
+const udpTrackerMagic = 0x41727101980
+
+const dnsPort = 53
+
+// sniffBitTorrentUDP matches a DHT message (BEP 5), a uTP SYN (BEP 29) or a UDP tracker connect (BEP 15).
+func sniffBitTorrentUDP(port uint16, b []byte) bool {
+	// DHT messages are bencoded dictionaries and always carry the "y" key
+	if len(b) > 12 && b[0] == 'd' && b[len(b)-1] == 'e' &&
+		(bytes.HasPrefix(b, []byte("d1:ad2:id20:")) || bytes.HasPrefix(b, []byte("d1:rd2:id20:")) || bytes.Contains(b, []byte("1:y1:"))) {
+		return true
+	}
+	if port != dnsPort && utpSYN(b) {
+		return true
+	}
+	return len(b) >= 16 && binary.BigEndian.Uint64(b) == udpTrackerMagic && binary.BigEndian.Uint32(b[8:]) == 0
+}
+
+// utpSYN matches the header of a uTP SYN: type 4 version 1, no delay sample and no ack yet, a window advertised,
+// then the extension chain and no payload. A DNS query id can look like the first byte.
+func utpSYN(b []byte) bool {
+	if len(b) < 20 || b[0] != 0x41 {
+		return false
+	}
+	if binary.BigEndian.Uint32(b[8:]) != 0 || binary.BigEndian.Uint32(b[12:]) == 0 ||
+		binary.BigEndian.Uint16(b[16:]) == 0 || binary.BigEndian.Uint16(b[18:]) != 0 {
+		return false
+	}
+	// each extension starts with the type of the next one and its length
+	ext, rest := b[1], b[20:]
+	for ext != 0 {
+		if ext > 2 || len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return false
+		}
+		ext, rest = rest[0], rest[2+int(rest[1]):]
+	}
+	return len(rest) == 0
+}
+
+// sniffHTTP reads the Host header of an HTTP/1 request.
+func sniffHTTP(b []byte) (string, bool) {
+	isHTTP := false
+	for _, m := range httpMethods {
+		isHTTP = isHTTP || bytes.HasPrefix(b, []byte(m))
+	}
+	if !isHTTP {
+		return "", false
+	}
+	head, _, _ := bytes.Cut(b, []byte("\r\n\r\n"))
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), "host") {
+			v = strings.TrimSpace(v)
+			if h, _, err := net.SplitHostPort(v); err == nil {
+				v = h
+			}
+			return v, true
+		}
+	}
+	return "", true
+}
+
+// sniffTLS reads the server name of a TLS ClientHello, the hello must be in the first record.
+func sniffTLS(b []byte) (string, bool) {
+	if len(b) < 5 || b[0] != 0x16 || b[1] != 0x03 {
+		return "", false
+	}
+	b = b[5:]
+	if len(b) < 4 || b[0] != 0x01 { //client hello
+		return "", false
+	}
+	b = b[4:]
+	// version, random
+	if len(b) < 34 {
+		return "", true
+	}
+	b = b[34:]
+	skip := func(lenBytes int) bool {
+		if len(b) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenBytes] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenBytes+n {
+			return false
+		}
+		b = b[lenBytes+n:]
+		return true
+	}
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) || len(b) < 2 {
+		return "", true
+	}
+	ext := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(ext) {
+		ext = ext[:n]
+	}
+	for len(ext) >= 4 {
+		typ, n := binary.BigEndian.Uint16(ext), int(binary.BigEndian.Uint16(ext[2:]))
+		ext = ext[4:]
+		if len(ext) < n {
+			break
+		}
+		if typ == 0 { //server_name
+			return sniffServerName(ext[:n]), true
+		}
+		ext = ext[n:]
+	}
+	return "", true
+}
+
+func sniffServerName(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 3 {
+		typ, n := b[0], int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		if len(b) < n {
+			return ""
+		}
+		if typ == 0 { //host_name
+			return string(b[:n])
+		}
+		b = b[n:]
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package routing
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// utpHeader builds a uTP header: type and version, first extension, connection id, timestamps, window, seq and ack.
+func utpHeader(typeVer, ext byte, tsDiff, wnd uint32, seq, ack uint16) []byte {
+	b := []byte{typeVer, ext}
+	b = binary.BigEndian.AppendUint16(b, 0x1234)
+	b = binary.BigEndian.AppendUint32(b, 0x01020304)
+	b = binary.BigEndian.AppendUint32(b, tsDiff)
+	b = binary.BigEndian.AppendUint32(b, wnd)
+	b = binary.BigEndian.AppendUint16(b, seq)
+	return binary.BigEndian.AppendUint16(b, ack)
+}
+
+func TestSniffUDP(t *testing.T) {
+	syn := utpHeader(0x41, 0, 0, 1<<20, 1, 0)
+	withExt := append(utpHeader(0x41, 2, 0, 1<<20, 7, 0), 0, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+	tracker := binary.BigEndian.AppendUint64(nil, udpTrackerMagic)
+	tracker = append(tracker, 0, 0, 0, 0, 1, 2, 3, 4)
+	tests := []struct {
+		name    string
+		port    uint16
+		payload []byte
+		want    string
+	}{
+		{"dht ping", 6881, []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), ProtocolBitTorrent},
+		{"dht reply", 6881, []byte("d1:rd2:id20:abcdefghij0123456789e1:t2:aa1:y1:re"), ProtocolBitTorrent},
+		{"utp syn", 40000, syn, ProtocolBitTorrent},
+		{"utp syn with extension", 40000, withExt, ProtocolBitTorrent},
+		{"utp syn on the dns port", dnsPort, syn, ""},
+		{"utp syn with payload", 40000, append(syn, 'x'), ""},
+		{"utp data", 40000, utpHeader(0x01, 0, 0, 1<<20, 1, 0), ""},
+		{"utp no window", 40000, utpHeader(0x41, 0, 0, 0, 1, 0), ""},
+		{"utp delay sample", 40000, utpHeader(0x41, 0, 5, 1<<20, 1, 0), ""},
+		{"utp acked", 40000, utpHeader(0x41, 0, 0, 1<<20, 1, 9), ""},
+		{"utp zero seq", 40000, utpHeader(0x41, 0, 0, 1<<20, 0, 0), ""},
+		{"utp unknown extension", 40000, append(utpHeader(0x41, 3, 0, 1<<20, 1, 0), 0, 0), ""},
+		{"utp truncated extension", 40000, append(utpHeader(0x41, 2, 0, 1<<20, 1, 0), 0, 8, 0), ""},
+		{"udp tracker connect", 6969, tracker, ProtocolBitTorrent},
+		{"quic initial", 443, append([]byte{0xc3, 0, 0, 0, 1}, make([]byte, 40)...), ""},
+		{"short", 40000, []byte{0x41, 0}, ""},
+	}
+	for _, tt := range tests {
+		if got, _ := Sniff("udp", tt.port, tt.payload); got != tt.want {
+			t.Errorf("%s: Sniff = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// suffixTrie holds domain suffixes by label from the TLD down, a lookup walks the labels of the domain once.
+type suffixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	end      bool //a suffix ends here
+	children map[string]*trieNode
+}
+
+func (t *suffixTrie) add(domain string) {
+	n := &t.root
+	for rest := domain; rest != ""; {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		if n.children == nil {
+			n.children = make(map[string]*trieNode)
+		}
+		child := n.children[label]
+		if child == nil {
+			child = &trieNode{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	n.end = true
+}
+
+// match reports if the domain or one of its parent domains was added.
+func (t *suffixTrie) match(domain string) bool {
+	n := &t.root
+	for rest := domain; rest != ""; {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		n = n.children[label]
+		if n == nil {
+			return false
+		}
+		if n.end {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrTree is a binary radix tree of prefixes, one per address family,
+// a lookup walks at most the address bits.
+type cidrTree struct {
+	v4, v6 cidrNode
+}
+
+type cidrNode struct {
+	end   bool
+	child [2]*cidrNode
+}
+
+func (t *cidrTree) add(p netip.Prefix) {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	p = p.Masked()
+	n := &t.v6
+	if p.Addr().Is4() {
+		n = &t.v4
+	}
+	b := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		if n.end {
+			return //covered by a shorter prefix
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &cidrNode{}
+		}
+		n = n.child[bit]
+	}
+	n.end = true
+	n.child = [2]*cidrNode{}
+}
+
+func (t *cidrTree) match(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	n := &t.v6
+	if ip.Is4() {
+		n = &t.v4
+	}
+	b := ip.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.end {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
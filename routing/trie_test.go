@@ -0,0 +1,83 @@
+package routing
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSuffixTrie(t *testing.T) {
+	var trie suffixTrie
+	for _, d := range []string{"example.com", "co.uk", "a.b.example.net"} {
+		trie.add(d)
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"a.b.c.example.com", true},
+		{"badexample.com", false},
+		{"com", false},
+		{"bbc.co.uk", true},
+		{"uk", false},
+		{"a.b.example.net", true},
+		{"x.a.b.example.net", true},
+		{"b.example.net", false},
+		{"example.net", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := trie.match(tt.domain); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestCIDRTree(t *testing.T) {
+	var tree cidrTree
+	for _, p := range []string{"10.0.0.0/8", "10.1.2.0/24", "192.168.1.128/25", "2001:db8::/32", "::ffff:203.0.113.0/120", "100.64.0.1/32"} {
+		tree.add(netip.MustParsePrefix(p))
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", true}, //inside the longer prefix covered by 10/8
+		{"10.255.255.255", true},
+		{"11.0.0.1", false},
+		{"192.168.1.128", true},
+		{"192.168.1.255", true},
+		{"192.168.1.127", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"203.0.113.7", true}, //an Is4In6 prefix is stored as IPv4
+		{"::ffff:203.0.113.7", true},
+		{"::ffff:10.0.0.1", true},
+		{"203.0.114.1", false},
+		{"100.64.0.1", true},
+		{"100.64.0.2", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := tree.match(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCIDRTreeCovering(t *testing.T) {
+	// a shorter prefix added after a longer one covers it
+	var tree cidrTree
+	tree.add(netip.MustParsePrefix("10.1.2.0/24"))
+	tree.add(netip.MustParsePrefix("10.0.0.0/8"))
+	if !tree.match(netip.MustParseAddr("10.9.9.9")) {
+		t.Error("10.9.9.9 not matched by 10.0.0.0/8 added after 10.1.2.0/24")
+	}
+	var all cidrTree
+	all.add(netip.MustParsePrefix("0.0.0.0/0"))
+	if !all.match(netip.MustParseAddr("1.2.3.4")) || all.match(netip.MustParseAddr("::1")) {
+		t.Error("0.0.0.0/0 must match every IPv4 address and no IPv6 address")
+	}
+}
@@ -0,0 +1,11 @@
+package schema
+
+// DstACL is a destination access list, ports are comma separated ports or ranges like "25,6000-7000".
+// A destination in DenyCidrs or DenyPorts, or outside AllowPorts when it is set, is denied,
+// else a destination in AllowCidrs is allowed, else the next list decides.
+type DstACL struct {
+	AllowCidrs []string `json:"allow_cidrs,omitempty"`
+	DenyCidrs  []string `json:"deny_cidrs,omitempty"`
+	AllowPorts string   `json:"allow_ports,omitempty"`
+	DenyPorts  string   `json:"deny_ports,omitempty"`
+}
@@ -0,0 +1,251 @@
+package schema
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMAC signing of the node <-> manager protocol.
+//
+// The request signature covers the method, the path with query, a unix timestamp,
+// a random nonce and the SHA-256 of the body. The response signature covers its own
+// timestamp, the nonce of the request and the SHA-256 of the response body, so a
+// response can not be replayed to another request.
+const (
+	HeaderTimestamp = "X-Unchain-Timestamp"
+	HeaderNonce     = "X-Unchain-Nonce"
+	HeaderSignature = "X-Unchain-Signature"
+
+	SignatureMaxSkew = 5 * time.Minute
+
+	signAlgoRequest  = "UNCHAIN-HMAC-SHA256"
+	signAlgoResponse = "UNCHAIN-HMAC-SHA256-RESPONSE"
+)
+
+var ErrSignature = errors.New("invalid signature")
+
+func hmacHex(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func checkTimestamp(ts string, now time.Time) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp", ErrSignature)
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew > SignatureMaxSkew || skew < -SignatureMaxSkew {
+		return fmt.Errorf("%w: timestamp skew %s", ErrSignature, skew.Round(time.Second))
+	}
+	return nil
+}
+
+func requestSignature(secret, method, uri, ts, nonce string, body []byte) string {
+	return hmacHex(secret, signAlgoRequest, method, uri, ts, nonce, bodyHash(body))
+}
+
+func responseSignature(secret, ts, nonce string, body []byte) string {
+	return hmacHex(secret, signAlgoResponse, ts, nonce, bodyHash(body))
+}
+
+// SignRequest adds the signature headers to the request and returns the nonce,
+// the caller needs the nonce to verify the response.
+func SignRequest(req *http.Request, body []byte, secret string) (nonce string) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce = newNonce()
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, requestSignature(secret, req.Method, req.URL.RequestURI(), ts, nonce, body))
+	return nonce
+}
+
+// VerifyRequest checks the signature and the timestamp of a request,
+// use a NonceCache to reject replayed requests.
+func VerifyRequest(r *http.Request, body []byte, secret string, now time.Time) error {
+	ts := r.Header.Get(HeaderTimestamp)
+	if err := checkTimestamp(ts, now); err != nil {
+		return err
+	}
+	want := requestSignature(secret, r.Method, r.URL.RequestURI(), ts, r.Header.Get(HeaderNonce), body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(HeaderSignature))) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// SignResponse adds the signature headers of a response to the request carrying nonce.
+func SignResponse(h http.Header, nonce string, body []byte, secret string) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(HeaderTimestamp, ts)
+	h.Set(HeaderSignature, responseSignature(secret, ts, nonce, body))
+}
+
+// VerifyResponse checks the response was signed by the manager for the request carrying nonce.
+func VerifyResponse(h http.Header, body []byte, nonce, secret string, now time.Time) error {
+	ts := h.Get(HeaderTimestamp)
+	if err := checkTimestamp(ts, now); err != nil {
+		return err
+	}
+	want := responseSignature(secret, ts, nonce, body)
+	if !hmac.Equal([]byte(want), []byte(h.Get(HeaderSignature))) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// NonceCache remembers the nonces seen within the signature skew window, so a captured request can not be replayed.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// Check returns false if the nonce was seen already, otherwise it records it.
+func (c *NonceCache) Check(nonce string, now time.Time) bool {
+	if nonce == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, at := range c.seen {
+		if now.Sub(at) > 2*SignatureMaxSkew {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// NodeConfig is the runtime configuration a node pulls from the manager.
+// Nil or zero fields leave the node setting unchanged.
+type NodeConfig struct {
+	Version            string     `json:"version"`
+	Users              []NodeUser `json:"users"` //nil leaves the users unchanged, empty removes all managed users
+	SubAddresses       []string   `json:"sub_addresses,omitempty"`
+	LogLevel           string     `json:"log_level,omitempty"`
+	PushIntervalSecond int        `json:"push_interval_second,omitempty"`
+	Routing            string     `json:"routing,omitempty"` //routing rules in the routing file format (toml), replacing the node's RoutingFile
+}
+
+// NodeUser is a user and its limits as the manager sees it.
+type NodeUser struct {
+	UID         string   `json:"uid"`
+	Disabled    bool     `json:"disabled,omitempty"`
+	QuotaKb     int64    `json:"quota_kb"`           //available KB, 0 means unlimited
+	MaxSessions int64    `json:"max_sessions"`       //0 means unlimited
+	ACL         *DstACL  `json:"acl,omitempty"`      //per-user destination overrides
+	Outbound    string   `json:"outbound,omitempty"` //routing outbound of the user's sessions no rule matches
+	SockOpt     *SockOpt `json:"sockopt,omitempty"`  //socket options of the user's direct connections
+}
+
+// Server-sent events streamed from the manager to the node.
+// With HMAC signing every event carries a "sig" field, unknown to SSE and ignored by other clients,
+// that covers the stream request nonce, the event id, the event name and the SHA-256 of the data.
+const (
+	EventUsersUpsert = "users.upsert" //data: []NodeUser, added or changed users
+	EventUsersRemove = "users.remove" //data: []string, revoked user UUIDs
+	EventPing        = "ping"         //keepalive
+
+	signAlgoEvent = "UNCHAIN-HMAC-SHA256-EVENT"
+)
+
+func SignEvent(secret, nonce, id, event string, data []byte) string {
+	return hmacHex(secret, signAlgoEvent, nonce, id, event, bodyHash(data))
+}
+
+func VerifyEvent(secret, nonce, id, event string, data []byte, sig string) error {
+	want := SignEvent(secret, nonce, id, event, data)
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// AppStatVersion is the version of the AppStat fields, bumped when fields are added.
+// New fields are only ever added, so a manager reading an older version keeps working.
+//
+//	1: traffic, hostname, sub addresses, goroutine, version info
+//	2: load
+//	3: groups
+//	4: detections
+const AppStatVersion = 4
+
+// AppStat is the report a node pushes to the manager, the manager answers with the
+// map of allowed user UUIDs to their available KB, 0 means unlimited and exhausted users are left out.
+type AppStat struct {
+	StatVersion  int              `json:"stat_version,omitempty"` //missing means 1
+	ReportID     string           `json:"report_id"`              //idempotency key, retries of the same report share it
+	Traffic      map[string]int64 `json:"traffic"`                //KB, uplink plus downlink
+	TrafficUp    map[string]int64 `json:"traffic_up"`             //KB, client -> destination
+	TrafficDown  map[string]int64 `json:"traffic_down"`           //KB, destination -> client
+	Hostname     string           `json:"hostname"`
+	SubAddresses []string         `json:"sub_addresses"`
+	Goroutine    int64            `json:"goroutine"`
+	VersionInfo  string           `json:"version_info"`
+	Load         *NodeLoad        `json:"load,omitempty"`   //since version 2
+	Groups       []OutboundGroup  `json:"groups,omitempty"` //since version 3
+
+	Detections map[string]map[string]int64 `json:"detections,omitempty"` //since version 4, user UUID -> sniffed protocol -> sessions, when the node reports them
+}
+
+// OutboundGroup is the state of a routing outbound group of the node.
+type OutboundGroup struct {
+	Tag      string            `json:"tag"`
+	Strategy string            `json:"strategy"`
+	Probe    string            `json:"probe"`
+	Members  []OutboundMember  `json:"members"`
+	Users    map[string]string `json:"users"` //user UUID with open connections -> member of the user's last connection
+}
+
+type OutboundMember struct {
+	Tag       string    `json:"tag"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMs int64     `json:"latency_ms"` //of the last successful probe
+	Active    int64     `json:"active"`     //open connections
+	LastProbe time.Time `json:"last_probe"`
+	Error     string    `json:"error,omitempty"` //of the last probe
+}
+
+// NodeLoad is how busy a node is at the time of the report, to place users on the least loaded node.
+type NodeLoad struct {
+	UptimeSecond       int64            `json:"uptime_second"`
+	Sessions           int64            `json:"sessions"`             //active sessions
+	SessionsByProtocol map[string]int64 `json:"sessions_by_protocol"` //active sessions, e.g. vless-tcp, vless-udp
+	UpBps              int64            `json:"up_bps"`               //bytes per second client -> destination, over the last seconds
+	DownBps            int64            `json:"down_bps"`             //bytes per second destination -> client
+	CPUPercent         float64          `json:"cpu_percent"`          //process CPU over the last seconds, 100 is one core
+	NumCPU             int              `json:"num_cpu"`
+	MemorySys          uint64           `json:"memory_sys"`      //bytes obtained from the OS by the Go runtime
+	MemoryHeap         uint64           `json:"memory_heap"`     //bytes of allocated heap objects
+	Dials              int64            `json:"dials"`           //destination dials since start
+	DialErrors         int64            `json:"dial_errors"`     //failed destination dials since start
+	DialErrorRate      float64          `json:"dial_error_rate"` //failed / all dials over the last minute, 0 to 1
+}
@@ -0,0 +1,12 @@
+package schema
+
+// SockOpt are the socket options of the direct connections to the destinations, zero fields keep the system default.
+// Interface, Mark and FastOpen are Linux only.
+type SockOpt struct {
+	BindIP    string `json:"bind_ip,omitempty" toml:"bind_ip"`             //source address, destinations of the other family are skipped
+	Interface string `json:"interface,omitempty" toml:"interface"`         //SO_BINDTODEVICE, needs CAP_NET_RAW
+	Mark      int    `json:"mark,omitempty" toml:"mark"`                   //SO_MARK for policy routing, needs CAP_NET_ADMIN
+	KeepAlive int    `json:"tcp_keepalive,omitempty" toml:"tcp_keepalive"` //seconds between TCP keepalive probes, -1 disables them
+	FastOpen  bool   `json:"tcp_fast_open,omitempty" toml:"tcp_fast_open"` //TCP_FASTOPEN_CONNECT
+	NoDelay   *bool  `json:"tcp_nodelay,omitempty" toml:"tcp_nodelay"`     //TCP_NODELAY, on when not set
+}
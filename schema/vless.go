@@ -135,6 +135,15 @@ func (h ProtoVLESS) HostIP() net.IP {
 	return ip
 }
 
+// Host returns the destination domain or IP as sent by the client.
+func (h ProtoVLESS) Host() string {
+	return h.dstHost
+}
+
+func (h ProtoVLESS) Port() uint16 {
+	return h.dstPort
+}
+
 func (h ProtoVLESS) HostPort() string {
 	return net.JoinHostPort(h.dstHost, fmt.Sprintf("%d", h.dstPort))
 }
@@ -0,0 +1,69 @@
+package schema
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhook event types
+const (
+	WebhookSessionOpen   = "session.open"
+	WebhookSessionClose  = "session.close"
+	WebhookUserOverQuota = "user.over_quota"
+	WebhookInvalidUUID   = "auth.invalid_uuid" //an IP sent too many unknown UUIDs in a minute
+)
+
+// HeaderDelivery is the ID of a webhook batch, retries of the same batch share it.
+const HeaderDelivery = "X-Unchain-Delivery"
+
+const signAlgoWebhook = "UNCHAIN-HMAC-SHA256-WEBHOOK"
+
+// WebhookEvent is a node event, only the fields of its type are set.
+type WebhookEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	At         time.Time `json:"at"`
+	UID        string    `json:"uid,omitempty"`
+	Network    string    `json:"network,omitempty"`
+	Dst        string    `json:"dst,omitempty"`
+	RemoteIP   string    `json:"remote_ip,omitempty"`   //as reported by the reverse proxy
+	Up         int64     `json:"up,omitempty"`          //bytes, session.close
+	Down       int64     `json:"down,omitempty"`        //bytes, session.close
+	DurationMs int64     `json:"duration_ms,omitempty"` //session.close
+	QuotaKb    int64     `json:"quota_kb,omitempty"`    //user.over_quota
+	Failures   int       `json:"failures,omitempty"`    //auth.invalid_uuid, in the last minute
+}
+
+// WebhookBatch is the body POSTed to the webhook targets.
+type WebhookBatch struct {
+	ID       string         `json:"id"`
+	Hostname string         `json:"hostname"`
+	SentAt   time.Time      `json:"sent_at"`
+	Events   []WebhookEvent `json:"events"`
+	Dropped  int64          `json:"dropped,omitempty"` //events dropped since the previous batch because the queue was full
+}
+
+// SignWebhook sets the timestamp and signature headers of a webhook request,
+// the signature covers the timestamp, the delivery ID and the SHA-256 of the body.
+func SignWebhook(h http.Header, secret, delivery string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(HeaderTimestamp, ts)
+	h.Set(HeaderDelivery, delivery)
+	h.Set(HeaderSignature, hmacHex(secret, signAlgoWebhook, ts, delivery, bodyHash(body)))
+}
+
+// VerifyWebhook checks a webhook request signed by SignWebhook, for receivers written in Go.
+func VerifyWebhook(h http.Header, secret string, body []byte, now time.Time) error {
+	ts := h.Get(HeaderTimestamp)
+	if err := checkTimestamp(ts, now); err != nil {
+		return err
+	}
+	want := hmacHex(secret, signAlgoWebhook, ts, h.Get(HeaderDelivery), bodyHash(body))
+	if !hmac.Equal([]byte(want), []byte(h.Get(HeaderSignature))) {
+		return fmt.Errorf("%w: webhook signature mismatch", ErrSignature)
+	}
+	return nil
+}
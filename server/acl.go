@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unchainese/unchain/outbound"
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+var errDstDenied = errors.New("destination denied by acl")
+
+// destinations denied unless an allow list opens them: private, loopback, link-local,
+// multicast and reserved ranges, the cloud metadata addresses are link-local or CGNAT
+var defaultDenyPrefixes = mustPrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10", //CGNAT, Alibaba Cloud metadata 100.100.100.200
+	"127.0.0.0/8",
+	"169.254.0.0/16", //link-local, AWS/GCP/Azure metadata 169.254.169.254
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7", //unique local, AWS metadata fd00:ec2::254
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustPrefixes(cidrs ...string) []netip.Prefix {
+	res, err := routing.ParsePrefixes(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dstACL is a compiled schema.DstACL.
+type dstACL struct {
+	allow, deny           []netip.Prefix
+	allowPorts, denyPorts routing.PortRanges
+}
+
+func compileACL(a schema.DstACL) (*dstACL, error) {
+	var err error
+	res := &dstACL{}
+	if res.allow, err = routing.ParsePrefixes(a.AllowCidrs); err != nil {
+		return nil, err
+	}
+	if res.deny, err = routing.ParsePrefixes(a.DenyCidrs); err != nil {
+		return nil, err
+	}
+	if res.allowPorts, err = routing.ParsePorts(a.AllowPorts); err != nil {
+		return nil, err
+	}
+	if res.denyPorts, err = routing.ParsePorts(a.DenyPorts); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a *dstACL) portDenied(port uint16) bool {
+	return a.denyPorts.Contains(port) || (len(a.allowPorts) > 0 && !a.allowPorts.Contains(port))
+}
+
+// verdict returns 1 for allowed, -1 for denied and 0 when the list does not decide.
+func (a *dstACL) verdict(ip netip.Addr, port uint16) int {
+	if a.portDenied(port) {
+		return -1
+	}
+	if prefixesContain(a.deny, ip) {
+		return -1
+	}
+	if prefixesContain(a.allow, ip) {
+		return 1
+	}
+	return 0
+}
+
+// nodeACL is the destination policy of the node, rebuilt on reload.
+type nodeACL struct {
+	acl      *dstACL
+	localIPs []netip.Addr //addresses of this host, with ownPorts they are the node's own services
+	ownPorts []uint16
+	proxies  []netip.Prefix //reverse proxies whose client IP headers are trusted
+}
+
+func (app *App) loadACL() {
+	c := app.conf()
+	acl, err := compileACL(schema.DstACL{
+		AllowCidrs: c.DstAllowCidrList(),
+		DenyCidrs:  c.DstDenyCidrList(),
+		AllowPorts: c.DstAllowPorts,
+		DenyPorts:  c.DstDenyPorts,
+	})
+	if err != nil {
+		log.Println("Error in destination acl config, only the default deny list is used:", err)
+		acl = &dstACL{}
+	}
+	n := &nodeACL{acl: acl}
+	if n.proxies, err = routing.ParsePrefixes(c.TrustedProxyList()); err != nil {
+		log.Println("Error in TrustedProxies, no proxy headers are trusted:", err)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				n.localIPs = append(n.localIPs, p.Addr().Unmap())
+			}
+		}
+	}
+	n.ownPorts = append(n.ownPorts, uint16(c.ListenPort()))
+	if _, port, err := net.SplitHostPort(c.AdminListen); err == nil {
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			n.ownPorts = append(n.ownPorts, uint16(p))
+		}
+	}
+	app.acl.Store(n)
+}
+
+func (n *nodeACL) isOwnService(ip netip.Addr, port uint16) bool {
+	own := false
+	for _, p := range n.ownPorts {
+		own = own || p == port
+	}
+	if !own {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, l := range n.localIPs {
+		if l == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// allowDst decides if the user may reach ip:port. The node's own services are always denied,
+// then the user's overrides decide, then the node's lists, then the default deny ranges.
+func (app *App) allowDst(uid string, ip netip.Addr, port uint16) bool {
+	ip = ip.Unmap()
+	n := app.acl.Load()
+	if n.isOwnService(ip, port) {
+		return false
+	}
+	if u, ok := app.users.get(uid); ok && u.acl != nil {
+		if v := u.acl.verdict(ip, port); v != 0 {
+			return v > 0
+		}
+	}
+	if v := n.acl.verdict(ip, port); v != 0 {
+		return v > 0
+	}
+	return !prefixesContain(defaultDenyPrefixes, ip)
+}
+
+// checkDst applies the ACL before any outbound dials. A proxy outbound resolves the name itself,
+// so only the port and an IP literal host are checked here, the direct outbounds check every resolved address.
+func (app *App) checkDst(req *outbound.Request) error {
+	if ip, err := netip.ParseAddr(strings.Trim(req.Host, "[]")); err == nil {
+		if !app.allowDst(req.User, ip, req.Port) {
+			return fmt.Errorf("%w: %s", errDstDenied, req.Addr())
+		}
+		return nil
+	}
+	denied := app.acl.Load().acl.portDenied(req.Port)
+	if u, ok := app.users.get(req.User); ok && u.acl != nil {
+		denied = denied || u.acl.portDenied(req.Port)
+	}
+	if denied {
+		return fmt.Errorf("%w: %s", errDstDenied, req.Addr())
+	}
+	return nil
+}
+
+// resolveDst resolves the destination and keeps the addresses the user may reach,
+// the caller dials these addresses so a second DNS answer can not point somewhere else.
+func (app *App) resolveDst(ctx context.Context, req *outbound.Request, timeout time.Duration) ([]netip.Addr, error) {
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(strings.Trim(req.Host, "[]")); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", req.Host)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", req.Host, err)
+		}
+	}
+	allowed := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if app.allowDst(req.User, ip, req.Port) {
+			allowed = append(allowed, ip.Unmap())
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s %v", errDstDenied, req.Addr(), ips)
+	}
+	return allowed, nil
+}
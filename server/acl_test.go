@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/unchainese/unchain/global"
+	"github.com/unchainese/unchain/outbound"
+	"github.com/unchainese/unchain/schema"
+)
+
+const (
+	userA = "903bcd04-79e7-429c-bf0c-0456c7de9cd1"
+	userB = "903bcd04-79e7-429c-bf0c-0456c7de9cd2"
+)
+
+// newACLApp builds an app with the destination ACL of c and the users with their ACL overrides.
+func newACLApp(t *testing.T, c global.Config, acls map[string]*schema.DstACL) *App {
+	t.Helper()
+	app := &App{users: newUserTable()}
+	app.cfg.Store(&c)
+	app.loadACL()
+	for uid, acl := range acls {
+		u := User{UID: uid, Enabled: true}
+		if err := u.setACL(acl); err != nil {
+			t.Fatal(err)
+		}
+		app.users.add(u)
+	}
+	return app
+}
+
+func TestAllowDstDefaults(t *testing.T) {
+	app := newACLApp(t, global.Config{AppPort: "8081"}, nil)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"2606:4700::1111", true},
+		{"0.0.0.0", false},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false}, //AWS/GCP/Azure metadata
+		{"100.100.100.200", false}, //Alibaba Cloud metadata, CGNAT
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"::1", false},
+		{"fd00:ec2::254", false}, //AWS metadata, unique local
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		if got := app.allowDst("", netip.MustParseAddr(tt.ip), 443); got != tt.want {
+			t.Errorf("allowDst(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAllowDstOverrides(t *testing.T) {
+	app := newACLApp(t, global.Config{
+		AppPort:       "8081",
+		AdminListen:   "127.0.0.1:8014",
+		DstAllowCidrs: "10.0.5.0/24",
+		DstDenyCidrs:  "1.1.1.0/24",
+		DstDenyPorts:  "25",
+	}, map[string]*schema.DstACL{
+		userA: {AllowCidrs: []string{"10.9.0.0/16", "127.0.0.0/8"}, DenyPorts: "8443"},
+		userB: {DenyCidrs: []string{"8.8.8.0/24"}, AllowPorts: "80,443"},
+	})
+	tests := []struct {
+		name string
+		uid  string
+		dst  string
+		want bool
+	}{
+		{"node allow list opens a private range", "", "10.0.5.1:80", true},
+		{"outside the node allow list", "", "10.0.6.1:80", false},
+		{"node deny list", "", "1.1.1.1:443", false},
+		{"node denied port", "", "8.8.8.8:25", false},
+		{"user allow list", userA, "10.9.1.1:80", true},
+		{"user allow list is the user's only", userB, "10.9.1.1:80", false},
+		{"user denied port", userA, "8.8.8.8:8443", false},
+		{"user denied port in the user allow list", userA, "10.9.1.1:8443", false},
+		{"user allow list before the node denied port", userA, "10.9.1.1:25", true},
+		{"user deny list", userB, "8.8.8.8:443", false},
+		{"user deny list leaves the rest", userB, "8.8.4.4:443", true},
+		{"user allowed ports", userB, "8.8.4.4:8080", false},
+		{"unknown user", "903bcd04-79e7-429c-bf0c-0456c7de9cd9", "10.9.1.1:80", false},
+		{"loopback opened by the user", userA, "127.0.0.1:9000", true},
+		{"mapped loopback opened by the user", userA, "[::ffff:127.0.0.1]:9000", true},
+		{"own app port", userA, "127.0.0.1:8081", false},
+		{"own admin port", userA, "127.0.0.1:8014", false},
+		{"own app port on another loopback address", userA, "127.0.0.2:8081", false},
+		{"own app port mapped", userA, "[::ffff:127.0.0.1]:8081", false},
+	}
+	for _, tt := range tests {
+		dst := netip.MustParseAddrPort(tt.dst)
+		if got := app.allowDst(tt.uid, dst.Addr(), dst.Port()); got != tt.want {
+			t.Errorf("%s: allowDst(%s, %s) = %v, want %v", tt.name, tt.uid, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestAllowDstOwnServiceOnInterface(t *testing.T) {
+	local := localAddrs()
+	var ip netip.Addr
+	for a := range local {
+		if a.Is4() && !a.IsLoopback() {
+			ip = a
+			break
+		}
+	}
+	if !ip.IsValid() {
+		t.Skip("no IPv4 interface address")
+	}
+	cidr := netip.PrefixFrom(ip, 32).String()
+	app := newACLApp(t, global.Config{AppPort: "8081"}, map[string]*schema.DstACL{userA: {AllowCidrs: []string{cidr}}})
+	if app.allowDst(userA, ip, 8081) {
+		t.Errorf("allowDst(%s:8081) reached the node's own app port", ip)
+	}
+	if !app.allowDst(userA, ip, 9000) {
+		t.Errorf("allowDst(%s:9000) denied a port the user may reach", ip)
+	}
+}
+
+func TestCheckDst(t *testing.T) {
+	app := newACLApp(t, global.Config{AppPort: "8081", DstDenyPorts: "25"}, map[string]*schema.DstACL{
+		userA: {DenyPorts: "8443"},
+	})
+	tests := []struct {
+		uid  string
+		host string
+		port uint16
+		want bool
+	}{
+		{"", "example.com", 443, true}, //the name is resolved by the outbound, only the port is checked
+		{"", "example.com", 25, false},
+		{userA, "example.com", 8443, false},
+		{"", "8.8.8.8", 443, true},
+		{"", "127.0.0.1", 80, false},
+		{"", "[::1]", 80, false},
+		{"", "::ffff:127.0.0.1", 80, false},
+		{"", "169.254.169.254", 80, false},
+	}
+	for _, tt := range tests {
+		err := app.checkDst(&outbound.Request{Network: "tcp", Host: tt.host, Port: tt.port, User: tt.uid})
+		if (err == nil) != tt.want || (err != nil && !errors.Is(err, errDstDenied)) {
+			t.Errorf("checkDst(%s, %s:%d) = %v, want allowed %v", tt.uid, tt.host, tt.port, err, tt.want)
+		}
+	}
+}
+
+func TestResolveDst(t *testing.T) {
+	app := newACLApp(t, global.Config{AppPort: "8081"}, map[string]*schema.DstACL{
+		userA: {AllowCidrs: []string{"127.0.0.0/8", "::1/128"}},
+	})
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		uid  string
+		host string
+		port uint16
+		want bool
+	}{
+		{"name resolving to loopback", "", "localhost", 80, false}, //DNS rebinding, a public name pointing inside
+		{"loopback literal", "", "127.0.0.1", 80, false},
+		{"mapped loopback literal", "", "::ffff:127.0.0.1", 80, false},
+		{"metadata literal", "", "169.254.169.254", 80, false},
+		{"public literal", "", "8.8.8.8", 443, true},
+		{"loopback name opened by the user", userA, "localhost", 9000, true},
+		{"own app port by name", userA, "localhost", 8081, false},
+	}
+	for _, tt := range tests {
+		ips, err := app.resolveDst(ctx, &outbound.Request{Network: "tcp", Host: tt.host, Port: tt.port, User: tt.uid}, 5*time.Second)
+		if tt.want {
+			if err != nil || len(ips) == 0 {
+				t.Errorf("%s: resolveDst = %v %v, want addresses", tt.name, ips, err)
+			}
+			for _, ip := range ips {
+				if ip.Is4In6() {
+					t.Errorf("%s: resolveDst returned the mapped address %s", tt.name, ip)
+				}
+			}
+			continue
+		}
+		if !errors.Is(err, errDstDenied) {
+			t.Errorf("%s: resolveDst = %v %v, want errDstDenied", tt.name, ips, err)
+		}
+	}
+}
@@ -1,9 +1,8 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -13,19 +12,44 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/unchainese/unchain/global"
+	"github.com/unchainese/unchain/schema"
 )
 
 type App struct {
-	cfg               *global.Config
-	userUsedTrafficKb sync.Map // string -> int64
-	svr               *http.Server
-	exitSignal        chan os.Signal
-	bufferPool        *sync.Pool
-	upGrader          *websocket.Upgrader
+	cfg             atomic.Pointer[global.Config] //replaced as a whole when the config changes at runtime, use app.conf()
+	fileCfg         *global.Config                //the config as read from the file, before the manager overrides
+	nodeRouting     string                        //routing rules of the manager's node config, they replace RoutingFile, under reloadMu
+	reloadMu        sync.Mutex                    //serializes the config file reloads with the manager's node config
+	certs           *certStore
+	acl             atomic.Pointer[nodeACL]
+	routes          atomic.Pointer[routeTable]
+	users           *userTable
+	sessions        *sessionRegistry
+	meter           *trafficMeter
+	history         *usageHistory
+	reporter        *reporter
+	remote          *remoteConfig
+	endpoints       *endpointPool
+	telemetry       *telemetry
+	detections      *detections
+	webhooks        *webhooks
+	userCacheLoaded bool          //the last known manager users were restored at startup
+	reconfigured    chan struct{} //signals loopPush that the push interval may have changed
+	configLoop      atomic.Bool   //loopPullConfig is running
+	streamLoop      atomic.Bool   //loopStream is running
+	streamMu        sync.Mutex
+	streamCancel    context.CancelFunc //closes the current manager stream
+	stateMu         sync.Mutex         //serializes the state file writes with the acknowledgement of reports
+	svr             *http.Server
+	adminSvr        *http.Server
+	exitSignal      chan os.Signal
+	bufferPool      *sync.Pool
+	upGrader        *websocket.Upgrader
 }
 
 func (app *App) httpSvr() {
@@ -42,13 +66,32 @@ func (app *App) httpSvr() {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	if app.conf().AdminEnabled() {
+		if app.conf().AdminListen == "" {
+			mux.Handle("/admin/", app.adminHandler())
+		} else {
+			app.adminSvr = &http.Server{
+				Addr:         app.conf().AdminListen,
+				Handler:      app.adminHandler(),
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+		}
+	}
+
 	server := &http.Server{
-		Addr:         app.cfg.ListenAddr(),
+		Addr:         app.conf().ListenAddr(),
 		Handler:      mux,
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	if app.conf().TLSEnabled() {
+		if err := app.certs.load(app.conf().TLSCert, app.conf().TLSKey); err != nil {
+			log.Fatalf("Could not load tls certificate: %v\n", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: app.certs.getCertificate}
+	}
 	app.svr = server
 
 }
@@ -56,10 +99,20 @@ func (app *App) httpSvr() {
 func NewApp(c *global.Config, sig chan os.Signal) *App {
 	bufferSize := c.GetBufferSize()
 	app := &App{
-		cfg:               c,
-		userUsedTrafficKb: sync.Map{},
-		exitSignal:        sig,
-		svr:               nil,
+		users:        newUserTable(),
+		meter:        &trafficMeter{},
+		history:      newUsageHistory(),
+		reporter:     &reporter{failed: make(chan struct{}, 1)},
+		remote:       &remoteConfig{},
+		certs:        &certStore{},
+		endpoints:    newEndpointPool(),
+		telemetry:    newTelemetry(),
+		detections:   newDetections(),
+		webhooks:     newWebhooks(),
+		reconfigured: make(chan struct{}, 1),
+		sessions:     newSessionRegistry(),
+		exitSignal:   sig,
+		svr:          nil,
 		bufferPool: &sync.Pool{
 			New: func() interface{} {
 				return make([]byte, bufferSize)
@@ -75,160 +128,202 @@ func NewApp(c *global.Config, sig chan os.Signal) *App {
 			},
 		},
 	}
-	for _, userID := range c.UserIDS() {
-		app.userUsedTrafficKb.Store(userID, int64(0))
+	app.cfg.Store(c)
+	fileCfg := *c
+	app.fileCfg = &fileCfg
+	app.loadConfigUsers()
+	app.loadACL()
+	if err := app.loadRouting(); err != nil {
+		log.Fatalf("Could not load routing rules: %v\n", err)
+	}
+	if err := app.loadUserCache(); err != nil {
+		log.Println("Error loading user cache:", err)
+	}
+	if err := app.loadState(); err != nil {
+		log.Println("Error loading traffic state:", err)
+	}
+	if err := app.loadSpool(); err != nil {
+		log.Println("Error loading report spool:", err)
+	}
+	if c.HistoryFile != "" {
+		if err := app.history.load(c.HistoryFile); err != nil {
+			log.Println("Error loading usage history:", err)
+		}
 	}
 	app.httpSvr()
 	go app.loopPush()
+	app.startManagerLoops()
+	go app.loopSessions()
+	go app.loopCheckpoint()
+	go app.loopWebhooks()
 	return app
 }
 
+// Connect makes the first push to the manager. A managed node that can not reach any manager
+// and has no cached user list fails, with a cached list it starts and keeps retrying.
+func (app *App) Connect() error {
+	if !app.conf().Managed() {
+		slog.Info("standalone mode, no manager calls", "users", len(app.users.list()))
+		return nil
+	}
+	err := app.PushNode()
+	if err == nil {
+		return nil
+	}
+	if !app.userCacheLoaded {
+		return fmt.Errorf("no manager reachable and no cached user list (UserCacheFile): %w", err)
+	}
+	slog.Warn("no manager reachable, starting with the cached users", "err", err)
+	return nil
+}
+
+// startManagerLoops starts the config poll and the manager stream when their URLs are set and they are not running,
+// a loop stops by itself once its URLs are gone.
+func (app *App) startManagerLoops() {
+	if app.configPolled() && app.configLoop.CompareAndSwap(false, true) {
+		go app.loopPullConfig()
+	}
+	if app.streamed() && app.streamLoop.CompareAndSwap(false, true) {
+		go app.loopStream()
+	}
+}
+
+func (app *App) configPolled() bool {
+	return app.conf().Managed() && len(app.conf().ConfigUrls()) > 0
+}
+
+func (app *App) streamed() bool {
+	return app.conf().Managed() && len(app.conf().StreamUrls()) > 0
+}
+
+// keepLooping reports whether a manager loop goes on. A loop that stops clears running
+// and takes over again when a reload enabled it meanwhile.
+func keepLooping(running *atomic.Bool, enabled func() bool) bool {
+	if enabled() {
+		return true
+	}
+	running.Store(false)
+	return enabled() && running.CompareAndSwap(false, true)
+}
+
+// conf returns the current config, do not modify it.
+func (app *App) conf() *global.Config {
+	return app.cfg.Load()
+}
+
 func (app *App) Run() {
-	log.Println("server starting on http://", app.cfg.ListenAddr())
-	if err := app.svr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("Could not listen on %s: %v\n", app.cfg.ListenAddr(), err)
+	if app.adminSvr != nil {
+		go func() {
+			log.Println("admin api starting on http://", app.adminSvr.Addr)
+			if err := app.adminSvr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Println("admin api stopped:", err)
+			}
+		}()
+	}
+	var err error
+	if app.conf().TLSEnabled() {
+		log.Println("server starting on https://", app.conf().ListenAddr())
+		err = app.svr.ListenAndServeTLS("", "")
+	} else {
+		log.Println("server starting on http://", app.conf().ListenAddr())
+		err = app.svr.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Could not listen on %s: %v\n", app.conf().ListenAddr(), err)
 	}
 }
 
 func (app *App) PrintVLESSConnectionURLS() {
-	listenPort := app.cfg.ListenPort()
+	listenPort := app.conf().ListenPort()
 
 	fmt.Printf("\n\n visit to get VLESS connection info: http://127.0.0.1:%d/sub/<YOUR_CONFIGED_UUID> \n", listenPort)
 	fmt.Printf("visit to get VLESS connection info: http://<HOST>:%d/sub/<YOUR_UUID>\n", listenPort)
 
-	app.userUsedTrafficKb.Range(func(id, _ interface{}) bool {
-		userID := id.(string)
-		fmt.Println("\n------------- USER UUID:  ", userID, " -------------")
-		urls := app.vlessUrls(userID)
+	for _, u := range app.users.list() {
+		fmt.Println("\n------------- USER UUID:  ", u.UID, " -------------")
+		urls := app.vlessUrls(u.UID)
 		for _, url := range urls {
 			fmt.Println(url)
 		}
-		return true
-	})
-	fmt.Println("\n\n\n")
+	}
+	fmt.Print("\n\n\n\n")
 }
 
 func (app *App) Shutdown(ctx context.Context) {
 	log.Println("Shutting down the server...")
+	if app.adminSvr != nil {
+		app.adminSvr.Shutdown(ctx)
+	}
+	for _, s := range app.sessions.all() {
+		app.flushSession(s)
+	}
+	app.checkpoint()
 	if err := app.svr.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 	log.Println("Server exiting")
 }
 
-func (app *App) loopPush() {
-	url := app.cfg.RegisterUrl
-	if url == "" {
-		log.Println("Register url is empty, skip register, runs in standalone mode")
-		url = "https://unchainapi.bob99.workers.dev/api/node"
-	}
-	tk := time.NewTicker(app.cfg.PushInterval())
-	defer tk.Stop()
-	for {
-		select {
-		case sig := <-app.exitSignal:
-			app.exitSignal <- sig
-			app.PushNode() //last push
-			return
-		case <-tk.C:
-			app.PushNode()
-		}
-	}
-}
-
-func (app *App) trafficInc(uid string, byteN int64) {
-	if !app.cfg.EnableUsageMetering() {
+// trafficInc counts uplink and downlink bytes for the user, it is safe to call from many sessions at once.
+func (app *App) trafficInc(uid, dst string, up, down int64) {
+	if !app.conf().EnableUsageMetering() {
 		return
 	}
-	kb := byteN >> 10
-	value, ok := app.userUsedTrafficKb.Load(uid)
-	if ok {
-		iv, isInt64 := value.(int64)
-		if isInt64 {
-			kb += iv
-		} else {
-			slog.Error("not a int64", "uid", uid, "value", value)
-		}
+	app.meter.add(uid, up, down)
+	app.users.addUsed(uid, up+down)
+	if app.conf().HistoryFile != "" {
+		app.history.record(uid, dst, time.Now(), up, down)
 	}
-	app.userUsedTrafficKb.Store(uid, kb)
 }
 
-func (app *App) stat() *AppStat {
-	data := make(map[string]int64)
-	app.userUsedTrafficKb.Range(func(key, value interface{}) bool {
-		data[key.(string)] = value.(int64)
-		return true
-	})
+func (app *App) stat() *schema.AppStat {
+	return app.statOf(app.meter.snapshot())
+}
+
+// statOf builds the stat of the given usage snapshot, traffic is rounded down to KB here and only here.
+func (app *App) statOf(usage map[string]trafficUsage) *schema.AppStat {
+	data := make(map[string]int64, len(usage))
+	dataUp := make(map[string]int64, len(usage))
+	dataDown := make(map[string]int64, len(usage))
+	for uid, u := range usage {
+		up, down := u.Kb()
+		if up == 0 && down == 0 {
+			continue
+		}
+		data[uid] = up + down
+		dataUp[uid] = up
+		dataDown[uid] = down
+	}
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown"
 		slog.Error(err.Error())
 	}
-	res := &AppStat{
+	res := &schema.AppStat{
+		StatVersion: schema.AppStatVersion,
 		Traffic:     data,
+		TrafficUp:   dataUp,
+		TrafficDown: dataDown,
 		Hostname:    hostname,
 		Goroutine:   int64(runtime.NumGoroutine()),
-		VersionInfo: app.cfg.GitHash + " -> " + app.cfg.BuildTime,
+		VersionInfo: app.conf().GitHash + " -> " + app.conf().BuildTime,
+		Load:        app.telemetry.load(app.sessions.all()),
+		Groups:      app.groupStats(),
 	}
-	res.SubAddresses = app.cfg.SubHostWithPort()
+	res.SubAddresses = app.conf().SubHostWithPort()
 	return res
 }
 
-type AppStat struct {
-	Traffic      map[string]int64 `json:"traffic"`
-	Hostname     string           `json:"hostname"`
-	SubAddresses []string         `json:"sub_addresses"`
-	Goroutine    int64            `json:"goroutine"`
-	VersionInfo  string           `json:"version_info"`
-}
-
-func (app *App) PushNode() {
-	url := app.cfg.RegisterUrl
-	if url == "" {
-		return
-	}
-	args := app.stat()
-	body := bytes.NewBuffer(nil)
-	err := json.NewEncoder(body).Encode(args)
-	if err != nil {
-		log.Println("Error encoding request:", err)
-		return
-	}
-
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		log.Println("Error registering:", err)
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", app.cfg.RegisterToken)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Error registering:", err)
-		return
-	}
-	defer resp.Body.Close()
-	users := make(map[string]int64)
-	err = json.NewDecoder(resp.Body).Decode(&users)
-	if err != nil {
-		log.Println("Error decoding response:", err)
-		return
-	}
-	app.userUsedTrafficKb.Clear()
-	const dummyUsedKB = int64(0)
-	for k, userAvailableKB := range users {
-		slog.Debug("user available traffic", "uid", k, "available", userAvailableKB)
-		app.userUsedTrafficKb.Store(k, dummyUsedKB) //set allowed userID
-	}
-	app.cfg.UserIDS()
-	//append config file UUIDs
-	for _, id := range app.cfg.UserIDS() {
-		app.userUsedTrafficKb.Store(id, dummyUsedKB)
+// loadConfigUsers adds the AllowUsers UUIDs of the config file, they never expire.
+func (app *App) loadConfigUsers() {
+	users := make([]User, 0)
+	for _, id := range app.conf().UserIDS() {
+		users = append(users, User{UID: id, Enabled: true})
 	}
+	app.users.replaceSource(userSourceConfig, users)
 }
 
 func (app *App) IsUserNotAllowed(uuid string) (isNotAllowed bool) {
-	_, ok := app.userUsedTrafficKb.Load(uuid)
-	return !ok
+	u, ok := app.users.get(uuid)
+	return !ok || !u.Enabled || u.overQuota()
 }
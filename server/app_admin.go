@@ -0,0 +1,366 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+// adminHandler serves the admin REST API, every request must carry the AdminToken as a Bearer token.
+//
+//	GET    /admin/users
+//	POST   /admin/users                {"uid":"...","enabled":true,"quota_kb":0,"max_sessions":0}
+//	GET    /admin/users/{uid}
+//	DELETE /admin/users/{uid}
+//	POST   /admin/users/{uid}/enable
+//	POST   /admin/users/{uid}/disable
+//	POST   /admin/users/{uid}/reset
+//	PATCH  /admin/users/{uid}/limits   {"quota_kb":1024,"max_sessions":2}
+//	GET    /admin/users/{uid}/usage?period=hourly|daily&format=json|csv
+//	GET    /admin/users/{uid}/destinations?format=json|csv
+//	PUT    /admin/users/{uid}/acl      {"allow_cidrs":["10.0.5.0/24"],"deny_ports":"25"}, null clears it
+//	PUT    /admin/users/{uid}/outbound {"outbound":"proxy"}, "" goes back to the default
+//	PUT    /admin/users/{uid}/sockopt  {"bind_ip":"203.0.113.7","mark":100}, null clears it
+//	GET    /admin/outbounds
+//	GET    /admin/detections
+//	GET    /admin/managers
+func (app *App) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/users", app.adminListUsers)
+	mux.HandleFunc("POST /admin/users", app.adminAddUser)
+	mux.HandleFunc("GET /admin/users/{uid}", app.adminGetUser)
+	mux.HandleFunc("DELETE /admin/users/{uid}", app.adminRemoveUser)
+	mux.HandleFunc("POST /admin/users/{uid}/enable", app.adminSetUserEnabled(true))
+	mux.HandleFunc("POST /admin/users/{uid}/disable", app.adminSetUserEnabled(false))
+	mux.HandleFunc("POST /admin/users/{uid}/reset", app.adminResetUser)
+	mux.HandleFunc("PATCH /admin/users/{uid}/limits", app.adminSetUserLimits)
+	mux.HandleFunc("GET /admin/users/{uid}/usage", app.adminUserUsage)
+	mux.HandleFunc("GET /admin/users/{uid}/destinations", app.adminUserDestinations)
+	mux.HandleFunc("PUT /admin/users/{uid}/acl", app.adminSetUserACL)
+	mux.HandleFunc("PUT /admin/users/{uid}/outbound", app.adminSetUserOutbound)
+	mux.HandleFunc("PUT /admin/users/{uid}/sockopt", app.adminSetUserSockOpt)
+	mux.HandleFunc("GET /admin/outbounds", app.adminOutbounds)
+	mux.HandleFunc("GET /admin/detections", app.adminDetections)
+	mux.HandleFunc("GET /admin/managers", app.adminManagers)
+	return app.adminAuth(mux)
+}
+
+func (app *App) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(app.conf().AdminToken)) != 1 {
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
+
+// adminUID returns the normalized {uid} path value, it writes a 400 response if the UUID is invalid.
+func adminUID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	uid, ok := normalizeUID(r.PathValue("uid"))
+	if !ok {
+		adminError(w, http.StatusBadRequest, "invalid uuid")
+	}
+	return uid, ok
+}
+
+func (app *App) adminListUsers(w http.ResponseWriter, _ *http.Request) {
+	adminJSON(w, http.StatusOK, app.users.list())
+}
+
+// adminOutbounds shows the outbound groups: member health, latency, connections and the member each user last used.
+func (app *App) adminOutbounds(w http.ResponseWriter, _ *http.Request) {
+	groups := app.groupStats()
+	if groups == nil {
+		groups = make([]schema.OutboundGroup, 0)
+	}
+	adminJSON(w, http.StatusOK, groups)
+}
+
+// adminDetections shows the sessions of the detected protocols since start, in total and per user.
+func (app *App) adminDetections(w http.ResponseWriter, _ *http.Request) {
+	adminJSON(w, http.StatusOK, app.detections.stat())
+}
+
+// adminManagers shows the health of the manager endpoints.
+func (app *App) adminManagers(w http.ResponseWriter, _ *http.Request) {
+	c := app.conf()
+	adminJSON(w, http.StatusOK, map[string][]endpointHealth{
+		"register": app.endpoints.list(c.RegisterUrls()),
+		"config":   app.endpoints.list(c.ConfigUrls()),
+		"stream":   app.endpoints.list(c.StreamUrls()),
+	})
+}
+
+func (app *App) adminGetUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	u, ok := app.users.get(uid)
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	adminJSON(w, http.StatusOK, u)
+}
+
+type adminUserArgs struct {
+	UID         string `json:"uid"`
+	Enabled     *bool  `json:"enabled"`
+	QuotaKb     *int64 `json:"quota_kb"`
+	MaxSessions *int64 `json:"max_sessions"`
+}
+
+func (a adminUserArgs) apply(u *User) {
+	if a.Enabled != nil {
+		u.Enabled = *a.Enabled
+	}
+	if a.QuotaKb != nil {
+		u.QuotaKb = max(*a.QuotaKb, 0)
+	}
+	if a.MaxSessions != nil {
+		u.MaxSessions = max(*a.MaxSessions, 0)
+	}
+}
+
+func (app *App) adminAddUser(w http.ResponseWriter, r *http.Request) {
+	args := adminUserArgs{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	uid, ok := normalizeUID(args.UID)
+	if !ok {
+		adminError(w, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+	// an existing user keeps its source and its other settings, only the given fields change
+	if u, ok := app.users.update(uid, args.apply); ok {
+		slog.Info("admin: user updated", "uid", uid, "enabled", u.Enabled, "quota_kb", u.QuotaKb, "max_sessions", u.MaxSessions)
+		app.enforceUsers()
+		adminJSON(w, http.StatusOK, u)
+		return
+	}
+	u := User{UID: uid, Source: userSourceAdmin, Enabled: true}
+	args.apply(&u)
+	if !app.users.add(u) {
+		adminError(w, http.StatusConflict, "user added concurrently")
+		return
+	}
+	slog.Info("admin: user added", "uid", uid, "quota_kb", u.QuotaKb, "max_sessions", u.MaxSessions)
+	adminJSON(w, http.StatusCreated, u)
+}
+
+func (app *App) adminRemoveUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	if !app.users.remove(uid) {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	slog.Info("admin: user removed", "uid", uid)
+	app.enforceUsers()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *App) adminSetUserEnabled(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := adminUID(w, r)
+		if !ok {
+			return
+		}
+		u, ok := app.users.update(uid, func(u *User) { u.Enabled = enabled })
+		if !ok {
+			adminError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		slog.Info("admin: user enabled changed", "uid", uid, "enabled", enabled)
+		app.enforceUsers()
+		adminJSON(w, http.StatusOK, u)
+	}
+}
+
+func (app *App) adminResetUser(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	u, ok := app.users.update(uid, func(u *User) { u.UsedBytes = 0 })
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	slog.Info("admin: user traffic reset", "uid", uid)
+	adminJSON(w, http.StatusOK, u)
+}
+
+func (app *App) adminSetUserLimits(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	args := adminUserArgs{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	args.Enabled = nil
+	u, ok := app.users.update(uid, args.apply)
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	slog.Info("admin: user limits changed", "uid", uid, "quota_kb", u.QuotaKb, "max_sessions", u.MaxSessions)
+	app.enforceUsers()
+	adminJSON(w, http.StatusOK, u)
+}
+
+// adminSetUserACL sets the destination overrides of the user, they apply to new connections.
+func (app *App) adminSetUserACL(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	var acl *schema.DstACL
+	if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var err error
+	u, ok := app.users.update(uid, func(u *User) { err = u.setACL(acl) })
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("admin: user acl changed", "uid", uid, "acl", acl)
+	adminJSON(w, http.StatusOK, u)
+}
+
+// adminSetUserSockOpt sets the socket options of the user's direct connections, they apply to new connections.
+func (app *App) adminSetUserSockOpt(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	var opt *schema.SockOpt
+	if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if opt != nil {
+		if err := routing.CheckSockOpt(*opt); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	u, ok := app.users.update(uid, func(u *User) { u.SockOpt = opt })
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	slog.Info("admin: user sockopt changed", "uid", uid, "sockopt", opt)
+	adminJSON(w, http.StatusOK, u)
+}
+
+func adminCSV(w http.ResponseWriter, name string, rows [][]string) {
+	w.Header().Set(contentTypeHeader, "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+}
+
+func (app *App) adminUserUsage(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "hourly"
+	}
+	if period != "hourly" && period != "daily" {
+		adminError(w, http.StatusBadRequest, "period must be hourly or daily")
+		return
+	}
+	buckets := app.history.buckets(uid, period == "daily")
+	if r.URL.Query().Get("format") != "csv" {
+		adminJSON(w, http.StatusOK, buckets)
+		return
+	}
+	rows := [][]string{{"start", "up_bytes", "down_bytes"}}
+	for _, b := range buckets {
+		rows = append(rows, []string{b.Start.Format(time.RFC3339), strconv.FormatInt(b.Up, 10), strconv.FormatInt(b.Down, 10)})
+	}
+	adminCSV(w, fmt.Sprintf("%s-%s.csv", uid, period), rows)
+}
+
+func (app *App) adminUserDestinations(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	top := app.history.destinations(uid)
+	if r.URL.Query().Get("format") != "csv" {
+		adminJSON(w, http.StatusOK, top)
+		return
+	}
+	rows := [][]string{{"host", "up_bytes", "down_bytes"}}
+	for _, d := range top {
+		rows = append(rows, []string{d.Host, strconv.FormatInt(d.Up, 10), strconv.FormatInt(d.Down, 10)})
+	}
+	adminCSV(w, uid+"-destinations.csv", rows)
+}
+
+// adminSetUserOutbound sets the routing outbound of the user's sessions no rule matches, they apply to new connections.
+func (app *App) adminSetUserOutbound(w http.ResponseWriter, r *http.Request) {
+	uid, ok := adminUID(w, r)
+	if !ok {
+		return
+	}
+	args := struct {
+		Outbound string `json:"outbound"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := app.routes.Load().dialers[args.Outbound]; args.Outbound != "" && !ok {
+		adminError(w, http.StatusBadRequest, "outbound not defined in the routing file")
+		return
+	}
+	u, ok := app.users.update(uid, func(u *User) { u.Outbound = args.Outbound })
+	if !ok {
+		adminError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	slog.Info("admin: user outbound changed", "uid", uid, "outbound", args.Outbound)
+	adminJSON(w, http.StatusOK, u)
+}
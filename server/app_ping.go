@@ -21,13 +21,31 @@ func (app *App) Ping(w http.ResponseWriter, _ *http.Request) {
 	}
 
 	lines := []string{
-		"BUILT HASH:  https://github.com/unchainese/unchain/tree/" + app.cfg.GitHash,
-		"BUILT TIME:  " + app.cfg.BuildTime,
-		"RUN_AT:     " + app.cfg.RunAt,
+		"BUILT HASH:  https://github.com/unchainese/unchain/tree/" + app.conf().GitHash,
+		"BUILT TIME:  " + app.conf().BuildTime,
+		"RUN_AT:     " + app.conf().RunAt,
 		fmt.Sprintf("GOROUTINE: %d", goroutineCount),
 		fmt.Sprintf("MEMORY.Alloc:    %.2fMB", float64(memStats.Alloc)/1024/1024),
 		fmt.Sprintf("MEMORY.TotalAlloc:    %.2fMB", float64(memStats.TotalAlloc)/1024/1024),
 		fmt.Sprintf("Used Traffic:    %d KB", n),
+		fmt.Sprintf("SESSIONS:    %d %v", stat.Load.Sessions, stat.Load.SessionsByProtocol),
+		fmt.Sprintf("THROUGHPUT:    up %.2fKB/s down %.2fKB/s", float64(stat.Load.UpBps)/1024, float64(stat.Load.DownBps)/1024),
+		fmt.Sprintf("CPU:    %.1f%%", stat.Load.CPUPercent),
+		fmt.Sprintf("DIALS:    %d failed %d", stat.Load.Dials, stat.Load.DialErrors),
+	}
+	if total := app.detections.stat().Total; len(total) > 0 {
+		lines = append(lines, fmt.Sprintf("DETECTIONS:    %v", total))
+	}
+	for _, g := range stat.Groups {
+		members := make([]string, 0, len(g.Members))
+		for _, m := range g.Members {
+			state := "down"
+			if m.Healthy {
+				state = fmt.Sprintf("%dms", m.LatencyMs)
+			}
+			members = append(members, fmt.Sprintf("%s(%s, %d conns)", m.Tag, state, m.Active))
+		}
+		lines = append(lines, fmt.Sprintf("GROUP %s %s:    %s", g.Tag, g.Strategy, strings.Join(members, " ")))
 	}
 	w.Write([]byte(strings.Join(lines, "\n\n")))
 }
@@ -64,8 +64,8 @@ func (app *App) Sub(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	lines := []string{
-		app.cfg.GitHash,
-		app.cfg.BuildTime,
+		app.conf().GitHash,
+		app.conf().BuildTime,
 		"VLESS Subscription URL:",
 	}
 	lines = append(lines, subURLs...)
@@ -74,7 +74,7 @@ func (app *App) Sub(w http.ResponseWriter, r *http.Request) {
 
 func (app *App) vlessUrls(uid string) []string {
 	var subURLs []string
-	for _, subAddr := range app.cfg.SubHostWithPort() {
+	for _, subAddr := range app.conf().SubHostWithPort() {
 		sub := vlessSub{
 			remark:       subAddr,
 			addrWithPort: subAddr,
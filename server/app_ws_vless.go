@@ -11,9 +11,9 @@ import (
 	"net"
 	"net/http"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/unchainese/unchain/outbound"
 	"github.com/unchainese/unchain/schema"
 
 	"github.com/gorilla/websocket"
@@ -27,10 +27,15 @@ const (
 	secWebSocketProto = "sec-websocket-protocol"
 )
 
-func startDstConnection(vd *schema.ProtoVLESS, timeout time.Duration) (net.Conn, []byte, error) {
-	conn, err := net.DialTimeout(vd.DstProtocol, vd.HostPort(), timeout)
+// startDstConnection connects the session to its destination through the outbound it was routed to.
+func (app *App) startDstConnection(ctx context.Context, sess *session, vd *schema.ProtoVLESS) (net.Conn, []byte, error) {
+	req := &outbound.Request{Network: vd.DstProtocol, Host: vd.Host(), Port: vd.Port(), User: sess.uid}
+	if err := app.checkDst(req); err != nil {
+		return nil, nil, err
+	}
+	conn, err := app.routes.Load().dialer(sess.outbound).Dial(ctx, req)
 	if err != nil {
-		return nil, nil, fmt.Errorf("connecting to destination: %w", err)
+		return nil, nil, err
 	}
 	return conn, []byte{vd.Version, 0x00}, nil
 }
@@ -78,42 +83,68 @@ func (app *App) WsVLESS(w http.ResponseWriter, r *http.Request) {
 		log.Println("Error parsing vless data:", err)
 		return
 	}
-	if app.IsUserNotAllowed(vData.UUID()) {
+	if !app.users.acquireSession(vData.UUID()) {
+		if _, ok := app.users.get(vData.UUID()); !ok {
+			app.authFailed(app.clientIP(r))
+		}
 		return
 	}
+	defer app.users.releaseSession(vData.UUID())
+
+	// the session is cancelled when the user is revoked, closing the websocket unblocks the relay goroutines
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopClose := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stopClose()
+	sess := &session{uid: vData.UUID(), network: vData.DstProtocol, dst: vData.HostPort(), startAt: time.Now(), cancel: cancel}
+	app.sessions.add(sess)
+	defer app.sessions.remove(sess)
+	remoteIP := app.clientIP(r)
+	app.emitEvent(schema.WebhookEvent{Type: schema.WebhookSessionOpen, UID: sess.uid, Network: sess.network, Dst: sess.dst, RemoteIP: remoteIP, At: sess.startAt})
+	defer func() {
+		app.emitEvent(schema.WebhookEvent{
+			Type: schema.WebhookSessionClose, UID: sess.uid, Network: sess.network, Dst: sess.dst, RemoteIP: remoteIP,
+			Up: sess.up.Load(), Down: sess.down.Load(), DurationMs: time.Since(sess.startAt).Milliseconds(),
+		})
+	}()
 
-	sessionTrafficByteN := int64(len(earlyData))
+	defer app.flushSession(sess)
+	app.routeSession(sess, vData)
+	sess.up.Add(int64(len(earlyData)))
 
 	if vData.DstProtocol == "udp" {
-		sessionTrafficByteN += app.vlessUDP(ctx, vData, ws)
+		app.vlessUDP(ctx, sess, vData, ws)
 	} else if vData.DstProtocol == "tcp" {
-		sessionTrafficByteN += app.vlessTCP(ctx, vData, ws)
+		app.vlessTCP(ctx, sess, vData, ws)
 	} else {
 		log.Println("Error unsupported protocol:", vData.DstProtocol)
 		return
 	}
-	go app.trafficInc(vData.UUID(), sessionTrafficByteN)
 }
 
 const readTimeOut = 60 * time.Second * 3
 
-func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websocket.Conn) int64 {
+func (app *App) vlessTCP(ctx context.Context, sess *session, sv *schema.ProtoVLESS, ws *websocket.Conn) {
 	logger := sv.Logger()
-	conn, headerVLESS, err := startDstConnection(sv, time.Millisecond*1000)
+	conn, headerVLESS, err := app.startDstConnection(ctx, sess, sv)
+	if !errors.Is(err, errDstDenied) && !errors.Is(err, errRouteBlocked) {
+		app.telemetry.countDial(err)
+	}
 	if err != nil {
 		logger.Error("Error starting session:", "err", err)
-		return 0
+		return
 	}
 	defer conn.Close()
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClose()
 	logger.Info("Session started tcp")
 
 	//write early data
 	_, err = conn.Write(sv.DataTcp())
 	if err != nil {
 		logger.Error("Error writing early data to TCP connection:", "err", err)
-		return 0
+		return
 	}
-	var trafficMeter atomic.Int64
 	var wg sync.WaitGroup
 
 	// Create cancellable context for proper goroutine cleanup
@@ -131,7 +162,7 @@ func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websock
 			default:
 				ws.SetReadDeadline(time.Now().Add(readTimeOut))
 				mt, message, err := ws.ReadMessage()
-				trafficMeter.Add(int64(len(message)))
+				sess.up.Add(int64(len(message)))
 				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 					return
 				}
@@ -146,6 +177,9 @@ func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websock
 				if mt != websocket.BinaryMessage {
 					continue
 				}
+				if sess.throttle(ctx, true, len(message)) != nil {
+					return
+				}
 				_, err = conn.Write(message)
 				if err != nil {
 					logger.Error("Error writing to TCP connection:", "err", err)
@@ -168,7 +202,7 @@ func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websock
 			default:
 				conn.SetReadDeadline(time.Now().Add(readTimeOut))
 				n, err := conn.Read(buf)
-				trafficMeter.Add(int64(n))
+				sess.down.Add(int64(n))
 				if errors.Is(err, io.EOF) {
 					return
 				}
@@ -176,6 +210,9 @@ func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websock
 					logger.Error("Error reading from TCP connection:", "err", err)
 					return
 				}
+				if sess.throttle(ctx, false, n) != nil {
+					return
+				}
 				data := buf[:n]
 				// send header data only for the first time
 				if hasNotSentHeader {
@@ -191,19 +228,26 @@ func (app *App) vlessTCP(ctx context.Context, sv *schema.ProtoVLESS, ws *websock
 		}
 	}()
 	wg.Wait()
-	return trafficMeter.Load()
 }
 
 // vlessUDP handles UDP traffic over VLESS protocol via WebSocket is tested ok
-func (app *App) vlessUDP(_ context.Context, sv *schema.ProtoVLESS, ws *websocket.Conn) (trafficMeter int64) {
+func (app *App) vlessUDP(ctx context.Context, sess *session, sv *schema.ProtoVLESS, ws *websocket.Conn) {
 	logger := sv.Logger()
-	conn, headerVLESS, err := startDstConnection(sv, time.Millisecond*1000)
+	conn, headerVLESS, err := app.startDstConnection(ctx, sess, sv)
+	if !errors.Is(err, errDstDenied) && !errors.Is(err, errRouteBlocked) {
+		app.telemetry.countDial(err)
+	}
 	if err != nil {
 		logger.Error("Error starting session:", "err", err)
 		return
 	}
 	defer conn.Close()
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClose()
 	udpData := sv.DataUdp()
+	if sess.throttle(ctx, true, len(udpData)) != nil {
+		return
+	}
 	_, err = conn.Write(udpData)
 	if err != nil {
 		logger.Error("Error writing early data to UDP connection:", "err", err)
@@ -218,6 +262,9 @@ func (app *App) vlessUDP(_ context.Context, sv *schema.ProtoVLESS, ws *websocket
 		logger.Error("Error reading from UDP connection:", "err", err)
 		return
 	}
+	if sess.throttle(ctx, false, n) != nil {
+		return
+	}
 	udpDataLen1 := (n >> 8) & 0xff
 	udpDataLen2 := n & 0xff
 	headerVLESS = append(headerVLESS, byte(udpDataLen1), byte(udpDataLen2))
@@ -229,7 +276,7 @@ func (app *App) vlessUDP(_ context.Context, sv *schema.ProtoVLESS, ws *websocket
 		logger.Error("Error writing to websocket:", "err", err)
 		return
 	}
-	return int64(len(headerVLESS)) + int64(len(udpData))
+	sess.down.Add(int64(len(headerVLESS)))
 }
 
 func vlessUdpDataMake(payload []byte) []byte {
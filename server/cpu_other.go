@@ -0,0 +1,10 @@
+//go:build !unix
+
+package server
+
+import "time"
+
+// processCPUTime is not measured on this platform, the CPU use is reported as 0.
+func processCPUTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/unchainese/unchain/routing"
+)
+
+// detectedProtocols are the sniffed protocols counted as detections, the ones hosting providers complain about.
+var detectedProtocols = map[string]bool{routing.ProtocolBitTorrent: true, routing.ProtocolSMTP: true}
+
+// detections counts the sessions of the detected protocols per user, it is safe for concurrent use.
+type detections struct {
+	mu      sync.Mutex
+	total   map[string]int64            //protocol -> sessions since start
+	users   map[string]map[string]int64 //user -> protocol -> sessions since start
+	pending map[string]map[string]int64 //user -> protocol -> sessions not reported to the manager yet
+}
+
+func newDetections() *detections {
+	return &detections{total: make(map[string]int64), users: make(map[string]map[string]int64), pending: make(map[string]map[string]int64)}
+}
+
+func addCount(m map[string]map[string]int64, uid, protocol string, n int64) {
+	if m[uid] == nil {
+		m[uid] = make(map[string]int64)
+	}
+	m[uid][protocol] += n
+	if m[uid][protocol] <= 0 {
+		delete(m[uid], protocol)
+	}
+	if len(m[uid]) == 0 {
+		delete(m, uid)
+	}
+}
+
+// add counts a session, report keeps it for the next manager report.
+func (d *detections) add(uid, protocol string, report bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.total[protocol]++
+	addCount(d.users, uid, protocol, 1)
+	if report {
+		addCount(d.pending, uid, protocol, 1)
+	}
+}
+
+// snapshot returns the counts not reported yet, nil when there are none.
+func (d *detections) snapshot() map[string]map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) == 0 {
+		return nil
+	}
+	res := make(map[string]map[string]int64, len(d.pending))
+	for uid, counts := range d.pending {
+		res[uid] = maps.Clone(counts)
+	}
+	return res
+}
+
+// sub removes the counts the manager acknowledged, counts of a report restored from the spool are gone already.
+func (d *detections) sub(reported map[string]map[string]int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for uid, counts := range reported {
+		for protocol, n := range counts {
+			if _, ok := d.pending[uid][protocol]; ok {
+				addCount(d.pending, uid, protocol, -min(n, d.pending[uid][protocol]))
+			}
+		}
+	}
+}
+
+// detectionStat is the detection counters since start, for the admin API.
+type detectionStat struct {
+	Total map[string]int64            `json:"total"` //protocol -> sessions
+	Users map[string]map[string]int64 `json:"users"` //user UUID -> protocol -> sessions
+}
+
+func (d *detections) stat() detectionStat {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := detectionStat{Total: maps.Clone(d.total), Users: make(map[string]map[string]int64, len(d.users))}
+	for uid, counts := range d.users {
+		res.Users[uid] = maps.Clone(counts)
+	}
+	return res
+}
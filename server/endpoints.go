@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a failed manager endpoint is skipped for a while, longer after each failure in a row
+const (
+	endpointCooldownMin = 2 * time.Second
+	endpointCooldownMax = 5 * time.Minute
+)
+
+// endpointHealth is the health of one manager URL, shown by the admin API.
+type endpointHealth struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"` //in a row
+	LastError string    `json:"last_error,omitempty"`
+	LastOK    time.Time `json:"last_ok"`
+	LastFail  time.Time `json:"last_fail"`
+	RetryAt   time.Time `json:"retry_at"`
+}
+
+// endpointPool tracks the health of the manager endpoints, it is safe for concurrent use.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+}
+
+func newEndpointPool() *endpointPool {
+	return &endpointPool{endpoints: make(map[string]*endpointHealth)}
+}
+
+func (p *endpointPool) getLocked(url string) *endpointHealth {
+	e, ok := p.endpoints[url]
+	if !ok {
+		e = &endpointHealth{URL: url, Healthy: true}
+		p.endpoints[url] = e
+	}
+	return e
+}
+
+// order returns the urls to try: the ones not cooling down in the configured order,
+// then the failed ones, the one to be retried soonest first.
+func (p *endpointPool) order(urls []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ready := make([]string, 0, len(urls))
+	waiting := make([]*endpointHealth, 0)
+	for _, url := range urls {
+		e := p.getLocked(url)
+		if e.RetryAt.After(now) {
+			waiting = append(waiting, e)
+		} else {
+			ready = append(ready, url)
+		}
+	}
+	sort.SliceStable(waiting, func(i, j int) bool { return waiting[i].RetryAt.Before(waiting[j].RetryAt) })
+	for _, e := range waiting {
+		ready = append(ready, e.URL)
+	}
+	return ready
+}
+
+func (p *endpointPool) success(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.getLocked(url)
+	if !e.Healthy {
+		slog.Info("manager endpoint recovered", "url", url, "failures", e.Failures)
+	}
+	e.Healthy = true
+	e.Failures = 0
+	e.LastOK = time.Now()
+	e.RetryAt = time.Time{}
+}
+
+func (p *endpointPool) failure(url string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.getLocked(url)
+	e.Healthy = false
+	e.Failures++
+	e.LastError = err.Error()
+	e.LastFail = time.Now()
+	cooldown := endpointCooldownMin << min(e.Failures-1, 10)
+	e.RetryAt = e.LastFail.Add(min(cooldown, endpointCooldownMax))
+	slog.Warn("manager endpoint failed", "url", url, "failures", e.Failures, "retry_at", e.RetryAt.Format(time.TimeOnly), "err", err)
+}
+
+// list returns the health of the given urls in the configured order.
+func (p *endpointPool) list(urls []string) []endpointHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]endpointHealth, 0, len(urls))
+	for _, url := range urls {
+		res = append(res, *p.getLocked(url))
+	}
+	return res
+}
+
+// managerDoAny sends the request to the first manager endpoint that answers,
+// trying them in failover order, it returns the URL that answered.
+func (app *App) managerDoAny(ctx context.Context, urls []string, method string, body []byte, header http.Header) (*managerResponse, string, error) {
+	if len(urls) == 0 {
+		return nil, "", errors.New("no manager endpoint configured")
+	}
+	errs := make([]error, 0)
+	for _, url := range app.endpoints.order(urls) {
+		resp, err := app.managerDo(ctx, method, url, body, header)
+		if err != nil {
+			app.endpoints.failure(url, err)
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		app.endpoints.success(url)
+		return resp, url, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
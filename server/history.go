@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unchainese/unchain/global"
+)
+
+// bounds of the usage history kept per user
+const (
+	historyHours        = 72 //hourly buckets
+	historyDays         = 62 //daily buckets
+	historyDestinations = 20 //top destinations reported
+	historyDstKeep      = 200
+	historyVersion      = 1
+)
+
+type usageBucket struct {
+	Start time.Time `json:"start"`
+	Up    int64     `json:"up"`
+	Down  int64     `json:"down"`
+}
+
+type destinationUsage struct {
+	Host string `json:"host"`
+	Up   int64  `json:"up"`
+	Down int64  `json:"down"`
+}
+
+type userHistory struct {
+	Hourly       []usageBucket            `json:"hourly"`
+	Daily        []usageBucket            `json:"daily"`
+	Destinations map[string]*trafficUsage `json:"destinations"`
+}
+
+// usageHistory keeps time-bucketed usage and top destinations per user, it is safe for concurrent use.
+type usageHistory struct {
+	mu    sync.Mutex
+	users map[string]*userHistory
+}
+
+func newUsageHistory() *usageHistory {
+	return &usageHistory{users: make(map[string]*userHistory)}
+}
+
+// addBucket adds the usage to the bucket starting at start and drops the buckets before oldest.
+func addBucket(buckets []usageBucket, start, oldest time.Time, up, down int64) []usageBucket {
+	n := len(buckets)
+	if n > 0 && buckets[n-1].Start.Equal(start) {
+		buckets[n-1].Up += up
+		buckets[n-1].Down += down
+	} else {
+		buckets = append(buckets, usageBucket{Start: start, Up: up, Down: down})
+	}
+	i := 0
+	for i < len(buckets) && buckets[i].Start.Before(oldest) {
+		i++
+	}
+	return buckets[i:]
+}
+
+func dstHost(hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+	return host
+}
+
+func (h *usageHistory) record(uid, dst string, at time.Time, up, down int64) {
+	at = at.UTC()
+	hour := at.Truncate(time.Hour)
+	day := at.Truncate(24 * time.Hour)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh, ok := h.users[uid]
+	if !ok {
+		uh = &userHistory{Destinations: make(map[string]*trafficUsage)}
+		h.users[uid] = uh
+	}
+	uh.Hourly = addBucket(uh.Hourly, hour, hour.Add(-historyHours*time.Hour), up, down)
+	uh.Daily = addBucket(uh.Daily, day, day.AddDate(0, 0, -historyDays), up, down)
+
+	host := dstHost(dst)
+	if host == "" {
+		return
+	}
+	d, ok := uh.Destinations[host]
+	if !ok {
+		if len(uh.Destinations) >= historyDstKeep*2 {
+			uh.pruneDestinations()
+		}
+		d = &trafficUsage{}
+		uh.Destinations[host] = d
+	}
+	d.Up += up
+	d.Down += down
+}
+
+func (uh *userHistory) topDestinations(n int) []destinationUsage {
+	res := make([]destinationUsage, 0, len(uh.Destinations))
+	for host, u := range uh.Destinations {
+		res = append(res, destinationUsage{Host: host, Up: u.Up, Down: u.Down})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		ti, tj := res[i].Up+res[i].Down, res[j].Up+res[j].Down
+		if ti != tj {
+			return ti > tj
+		}
+		return res[i].Host < res[j].Host
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// pruneDestinations keeps the busiest destinations only, so the map can not grow without limit.
+func (uh *userHistory) pruneDestinations() {
+	keep := uh.topDestinations(historyDstKeep)
+	uh.Destinations = make(map[string]*trafficUsage, len(keep))
+	for _, d := range keep {
+		uh.Destinations[d.Host] = &trafficUsage{Up: d.Up, Down: d.Down}
+	}
+}
+
+// buckets returns a copy of the hourly or daily buckets of the user, oldest first.
+func (h *usageHistory) buckets(uid string, daily bool) []usageBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh, ok := h.users[uid]
+	if !ok {
+		return []usageBucket{}
+	}
+	src := uh.Hourly
+	if daily {
+		src = uh.Daily
+	}
+	return append([]usageBucket{}, src...)
+}
+
+func (h *usageHistory) destinations(uid string) []destinationUsage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh, ok := h.users[uid]
+	if !ok {
+		return []destinationUsage{}
+	}
+	return uh.topDestinations(historyDestinations)
+}
+
+type historyFile struct {
+	Version int                     `json:"version"`
+	Users   map[string]*userHistory `json:"users"`
+}
+
+// save writes the history to file, users without traffic in the kept days are dropped.
+func (h *usageHistory) save(file string) error {
+	h.mu.Lock()
+	oldest := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -historyDays)
+	for uid, uh := range h.users {
+		if n := len(uh.Daily); n == 0 || uh.Daily[n-1].Start.Before(oldest) {
+			delete(h.users, uid)
+		}
+	}
+	data, err := json.Marshal(historyFile{Version: historyVersion, Users: h.users})
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return global.WriteFileAtomic(file, data)
+}
+
+func (h *usageHistory) load(file string) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hf := historyFile{}
+	if err := json.Unmarshal(data, &hf); err != nil {
+		return fmt.Errorf("decoding history file %s: %w", file, err)
+	}
+	if hf.Version != historyVersion {
+		return fmt.Errorf("history file %s has unsupported version %d", file, hf.Version)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for uid, uh := range hf.Users {
+		if uh.Destinations == nil {
+			uh.Destinations = make(map[string]*trafficUsage)
+		}
+		h.users[uid] = uh
+	}
+	slog.Info("usage history restored", "file", file, "users", len(hf.Users))
+	return nil
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/unchainese/unchain/outbound"
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+const (
+	defaultStickyTTL = 10 * time.Minute
+	maxPoolAddresses = 1 << 16
+)
+
+type stickyAddr struct {
+	addr netip.Addr
+	used time.Time
+}
+
+// poolDialer is a direct outbound leaving from an address of a pool, kept per user or per destination host
+// while it is used within the sticky TTL, or the next one for every connection.
+// IPv4 prefixes are expanded, an IPv6 prefix gives a random address of it.
+type poolDialer struct {
+	app      *App
+	tag      string
+	opt      schema.SockOpt
+	strategy string
+	ttl      time.Duration
+	v4       []netip.Addr
+	v6       []netip.Prefix
+
+	mu        sync.Mutex
+	next      [2]int //rotation index of v4 and v6
+	sticky    map[string]stickyAddr
+	lastSweep time.Time
+}
+
+func newPoolDialer(app *App, oc routing.OutboundConfig) (*poolDialer, error) {
+	prefixes, err := routing.ParsePrefixes(oc.Addresses)
+	if err != nil {
+		return nil, fmt.Errorf("outbound %q: %w", oc.Tag, err)
+	}
+	d := &poolDialer{app: app, tag: oc.Tag, opt: oc.SockOpt, strategy: oc.Strategy, ttl: defaultStickyTTL, sticky: make(map[string]stickyAddr)}
+	if d.strategy == "" {
+		d.strategy = routing.StrategyStickyUser
+	}
+	if oc.StickyTTL > 0 {
+		d.ttl = time.Duration(oc.StickyTTL) * time.Second
+	}
+	seen := make(map[netip.Addr]bool)
+	seen6 := make(map[netip.Prefix]bool)
+	for _, p := range prefixes {
+		if p.Addr().Is6() {
+			if !seen6[p] {
+				seen6[p] = true
+				d.v6 = append(d.v6, p)
+			}
+			continue
+		}
+		for ip := p.Addr(); p.Contains(ip); ip = ip.Next() {
+			//network and broadcast addresses can not be a source, a /31 has neither
+			if p.Bits() < 31 && (ip == p.Addr() || !p.Contains(ip.Next())) {
+				continue
+			}
+			if len(seen) >= maxPoolAddresses {
+				return nil, fmt.Errorf("outbound %q: more than %d IPv4 addresses", oc.Tag, maxPoolAddresses)
+			}
+			if seen[ip] {
+				continue
+			}
+			seen[ip] = true
+			d.v4 = append(d.v4, ip)
+		}
+	}
+	if local := localAddrs(); local != nil {
+		for ip := range seen {
+			if !local[ip] && !ip.IsLoopback() {
+				slog.Warn("ip pool address is not assigned to an interface of the node", "outbound", oc.Tag, "addr", ip)
+			}
+		}
+		for p := range seen6 {
+			if p.IsSingleIP() && !local[p.Addr()] && !p.Addr().IsLoopback() {
+				slog.Warn("ip pool address is not assigned to an interface of the node", "outbound", oc.Tag, "addr", p.Addr())
+			}
+		}
+	}
+	return d, nil
+}
+
+// localAddrs returns the addresses of the node interfaces, nil when they can not be listed.
+func localAddrs() map[netip.Addr]bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	res := make(map[netip.Addr]bool, len(addrs))
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil {
+			res[p.Addr().Unmap()] = true
+		}
+	}
+	return res
+}
+
+func (d *poolDialer) Dial(ctx context.Context, req *outbound.Request) (net.Conn, error) {
+	return d.app.dialDirect(ctx, req, d.opt, func(dst netip.Addr) (netip.Addr, error) {
+		src, ok := d.pick(req, dst.Is4())
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("ip pool %q has no address to reach %s", d.tag, dst)
+		}
+		slog.Debug("ip pool source picked", "outbound", d.tag, "userID", req.User, "dst", dst, "src", src)
+		return src, nil
+	})
+}
+
+// pick returns the source address of the connection for the destination family.
+func (d *poolDialer) pick(req *outbound.Request, is4 bool) (netip.Addr, bool) {
+	family, n := 0, len(d.v4)
+	if !is4 {
+		family, n = 1, len(d.v6)
+	}
+	if n == 0 {
+		return netip.Addr{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := ""
+	switch d.strategy {
+	case routing.StrategyStickyUser:
+		key = req.User
+	case routing.StrategyStickyDestination:
+		key = req.Host
+	}
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.ttl {
+		for k, s := range d.sticky {
+			if now.Sub(s.used) > d.ttl {
+				delete(d.sticky, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	key = fmt.Sprintf("%d/%s", family, key)
+	if s, ok := d.sticky[key]; ok && d.strategy != routing.StrategyRotate && now.Sub(s.used) <= d.ttl {
+		d.sticky[key] = stickyAddr{addr: s.addr, used: now}
+		return s.addr, true
+	}
+	var ip netip.Addr
+	if is4 {
+		ip = d.v4[d.next[family]%n]
+	} else {
+		ip = randomAddr(d.v6[d.next[family]%n])
+	}
+	d.next[family]++
+	if d.strategy != routing.StrategyRotate {
+		d.sticky[key] = stickyAddr{addr: ip, used: now}
+	}
+	return ip, true
+}
+
+// randomAddr returns a random address of the prefix, other than the subnet-router anycast address
+// (the prefix address) of prefixes shorter than /127.
+func randomAddr(p netip.Prefix) netip.Addr {
+	if p.IsSingleIP() {
+		return p.Addr()
+	}
+	base := p.Addr().As16()
+	for {
+		var r [16]byte
+		binary.BigEndian.PutUint64(r[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(r[8:], rand.Uint64())
+		b := base
+		for i := range b {
+			bits := min(max(p.Bits()-8*i, 0), 8)
+			mask := ^byte(0xff >> bits)
+			b[i] = b[i]&mask | r[i]&^mask
+		}
+		ip := netip.AddrFrom16(b)
+		if p.Bits() >= 127 || ip != p.Addr() {
+			return ip
+		}
+	}
+}
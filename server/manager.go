@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+const managerMaxBody = 16 << 20
+
+var managerClient = &http.Client{Timeout: 10 * time.Second}
+
+type managerResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// newManagerRequest builds a request to the manager, with ManagerAuth = hmac the request is signed
+// and the returned nonce is needed to verify the response, otherwise the RegisterToken is sent as is.
+func (app *App) newManagerRequest(ctx context.Context, method, url string, body []byte, header http.Header) (*http.Request, string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set(contentTypeHeader, contentTypeJSON)
+	}
+	nonce := ""
+	if app.conf().ManagerSigned() {
+		nonce = schema.SignRequest(req, body, app.conf().RegisterToken)
+	} else {
+		req.Header.Set("Authorization", app.conf().RegisterToken)
+	}
+	return req, nonce, nil
+}
+
+// managerDo sends a request to the manager and returns the response, only 2xx and 304 are no error.
+// With ManagerAuth = hmac the response signature, of a 304 too, is verified before anything of the body is returned.
+func (app *App) managerDo(ctx context.Context, method, url string, body []byte, header http.Header) (*managerResponse, error) {
+	req, nonce, err := app.newManagerRequest(ctx, method, url, body, header)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := managerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, managerMaxBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	res := &managerResponse{status: resp.StatusCode, header: resp.Header, body: data}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotModified {
+		return nil, fmt.Errorf("manager responded %s", resp.Status)
+	}
+	if app.conf().ManagerSigned() {
+		signed := data
+		if resp.StatusCode == http.StatusNotModified {
+			// a 304 is signed over the ETag it confirms, the one this node sent
+			signed = []byte(req.Header.Get("If-None-Match"))
+		}
+		if err := schema.VerifyResponse(resp.Header, signed, nonce, app.conf().RegisterToken, time.Now()); err != nil {
+			return nil, fmt.Errorf("manager response rejected: %w", err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// trafficCounter counts the bytes of a user not reported to the manager yet.
+type trafficCounter struct {
+	up   atomic.Int64 //client -> destination
+	down atomic.Int64 //destination -> client
+}
+
+// trafficUsage is a snapshot of a trafficCounter.
+type trafficUsage struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// Kb rounds the bytes down to whole KB, the remainder is kept by the meter for the next report.
+func (u trafficUsage) Kb() (up, down int64) {
+	return u.Up >> 10, u.Down >> 10
+}
+
+// trafficMeter holds per-user byte counters, it is safe for concurrent use.
+type trafficMeter struct {
+	counters sync.Map // string -> *trafficCounter
+}
+
+func (m *trafficMeter) counter(uid string) *trafficCounter {
+	if c, ok := m.counters.Load(uid); ok {
+		return c.(*trafficCounter)
+	}
+	c, _ := m.counters.LoadOrStore(uid, &trafficCounter{})
+	return c.(*trafficCounter)
+}
+
+func (m *trafficMeter) add(uid string, up, down int64) {
+	c := m.counter(uid)
+	c.up.Add(up)
+	c.down.Add(down)
+}
+
+// sub removes the reported bytes, usage counted after the snapshot is kept.
+// A counter never goes below zero, a report restored with more usage than the state only clears it.
+func (m *trafficMeter) sub(uid string, up, down int64) {
+	c := m.counter(uid)
+	subFloor(&c.up, up)
+	subFloor(&c.down, down)
+}
+
+func subFloor(v *atomic.Int64, n int64) {
+	for {
+		cur := v.Load()
+		if v.CompareAndSwap(cur, max(cur-n, 0)) {
+			return
+		}
+	}
+}
+
+func (m *trafficMeter) snapshot() map[string]trafficUsage {
+	data := make(map[string]trafficUsage)
+	m.counters.Range(func(key, value any) bool {
+		c := value.(*trafficCounter)
+		data[key.(string)] = trafficUsage{Up: c.up.Load(), Down: c.down.Load()}
+		return true
+	})
+	return data
+}
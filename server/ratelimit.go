@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// a limit unused this long is removed from the table, a session still holding it keeps throttling with it
+const rateLimitIdle = 10 * time.Minute
+
+// rateLimit throttles the sessions of a user a rate limited rule matched, each direction has its own bucket.
+type rateLimit struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+	used atomic.Int64 //unix time of the last use
+}
+
+func newRateLimit(kbps int) *rateLimit {
+	bps := kbps << 10
+	return &rateLimit{up: rate.NewLimiter(rate.Limit(bps), bps), down: rate.NewLimiter(rate.Limit(bps), bps)}
+}
+
+// limit returns the shared limit of the user for the rule, the table is replaced on reload so a changed limit applies to new sessions.
+func (rt *routeTable) limit(rule int, uid string, kbps int) *rateLimit {
+	now := time.Now()
+	rt.pruneLimits(now)
+	key := fmt.Sprintf("%d/%s", rule, uid)
+	l, ok := rt.limits.Load(key)
+	if !ok {
+		l, _ = rt.limits.LoadOrStore(key, newRateLimit(kbps))
+	}
+	rl := l.(*rateLimit)
+	rl.used.Store(now.Unix())
+	return rl
+}
+
+// pruneLimits removes the limits no session used for rateLimitIdle, at most once a minute.
+func (rt *routeTable) pruneLimits(now time.Time) {
+	last := rt.pruned.Load()
+	if now.Unix()-last < 60 || !rt.pruned.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	idle := now.Add(-rateLimitIdle).Unix()
+	rt.limits.Range(func(key, value any) bool {
+		if value.(*rateLimit).used.Load() < idle {
+			rt.limits.Delete(key)
+		}
+		return true
+	})
+}
+
+// throttle waits until n bytes of the session may pass, a session without a limit never waits.
+func (s *session) throttle(ctx context.Context, up bool, n int) error {
+	if s.limit == nil {
+		return nil
+	}
+	s.limit.used.Store(time.Now().Unix())
+	l := s.limit.down
+	if up {
+		l = s.limit.up
+	}
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"log"
+	"log/slog"
+	"reflect"
+
+	"github.com/unchainese/unchain/global"
+)
+
+// config fields only read at startup, a change is kept out of the live config until a restart
+var restartFields = map[string]bool{
+	"AppPort":     true,
+	"AdminListen": true,
+	"LogFile":     true,
+	"BufferSize":  true,
+	"Mode":        true,
+	//the files are read once at startup and written to until exit
+	"SpoolDir":      true,
+	"StateFile":     true,
+	"HistoryFile":   true,
+	"UserCacheFile": true,
+}
+
+// config fields logged as changed without their values
+var secretFields = map[string]bool{
+	"RegisterToken": true,
+	"AdminToken":    true,
+	"WebhookSecret": true,
+}
+
+type configChange struct {
+	field    string
+	old, new string
+}
+
+func (ch configChange) attr() slog.Attr {
+	if secretFields[ch.field] {
+		return slog.String(ch.field, "changed")
+	}
+	return slog.String(ch.field, ch.old+" -> "+ch.new)
+}
+
+// diffConfig lists the fields that differ, the build info fields are skipped.
+func diffConfig(old, next *global.Config) []configChange {
+	res := make([]configChange, 0)
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		switch name {
+		case "GitHash", "BuildTime", "RunAt":
+			continue
+		}
+		if o, n := ov.Field(i).String(), nv.Field(i).String(); o != n {
+			res = append(res, configChange{field: name, old: o, new: n})
+		}
+	}
+	return res
+}
+
+// Reload applies a re-read config file live: users, log level, limits, sub addresses, manager endpoints
+// and the TLS certificate. Running sessions are kept, except the ones of users no longer allowed.
+// Fields only read at startup keep their old value and are logged as needing a restart.
+func (app *App) Reload(next *global.Config) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	c := *next
+	changes := diffConfig(app.fileCfg, &c)
+	restart := make([]string, 0)
+	cv, ov := reflect.ValueOf(&c).Elem(), reflect.ValueOf(app.fileCfg).Elem()
+	keepOld := func(field string) {
+		cv.FieldByName(field).SetString(ov.FieldByName(field).String())
+		restart = append(restart, field)
+	}
+	changed := make(map[string]bool, len(changes))
+	attrs := make([]any, 0, len(changes))
+	for _, ch := range changes {
+		changed[ch.field] = true
+		attrs = append(attrs, ch.attr())
+		if restartFields[ch.field] {
+			keepOld(ch.field)
+		}
+	}
+	if app.fileCfg.AdminEnabled() != c.AdminEnabled() {
+		keepOld("AdminToken")
+	}
+	if app.fileCfg.TLSEnabled() != c.TLSEnabled() {
+		keepOld("TLSCert")
+		keepOld("TLSKey")
+	}
+	if c.TLSEnabled() {
+		if err := app.certs.load(c.TLSCert, c.TLSKey); err != nil {
+			log.Println("Error reloading tls certificate, the old one is kept:", err)
+		}
+	}
+
+	fileCfg := c
+	app.fileCfg = &fileCfg
+	app.cfg.Store(&c)
+	if last := app.remote.lastConfig(); last != nil && c.Managed() {
+		// the manager's node config still overrides the file
+		nc := *last
+		nc.Users = nil
+		app.applyNodeConfig(&nc)
+	}
+	slog.SetLogLoggerLevel(app.conf().LogLevel())
+	app.loadACL()
+	if err := app.loadRouting(); err != nil {
+		log.Println("Error reloading routing rules, the old ones are kept:", err)
+	}
+	if changed["AllowUsers"] {
+		app.loadConfigUsers()
+		app.enforceUsers()
+	}
+	if changed["RegisterUrl"] || changed["ConfigUrl"] || changed["RegisterToken"] || changed["ManagerAuth"] {
+		app.remote.reset()
+		if c.Managed() {
+			app.resync()
+		}
+	}
+	if changed["StreamUrl"] || changed["RegisterToken"] || changed["ManagerAuth"] {
+		app.restartStream()
+	}
+	app.startManagerLoops()
+	select {
+	case app.reconfigured <- struct{}{}:
+	default:
+	}
+
+	if len(changes) == 0 {
+		slog.Info("config reloaded, nothing changed")
+		return
+	}
+	slog.Info("config reloaded", attrs...)
+	if len(restart) > 0 {
+		slog.Warn("config changes need a restart to apply", "fields", restart)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+// remoteConfig is the node config last pulled from the manager.
+type remoteConfig struct {
+	mu      sync.Mutex //serializes the pulls
+	etag    string
+	version string
+	last    atomic.Pointer[schema.NodeConfig] //stored under reloadMu, so a reload sees the config applied last
+}
+
+func (rc *remoteConfig) lastConfig() *schema.NodeConfig {
+	return rc.last.Load()
+}
+
+// reset forgets the ETag and version, the next pull applies the node config again.
+func (rc *remoteConfig) reset() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.etag, rc.version = "", ""
+}
+
+// loopPullConfig polls ConfigUrl and applies the node config whenever the manager changes it,
+// until a reload removes ConfigUrl.
+func (app *App) loopPullConfig() {
+	for keepLooping(&app.configLoop, app.configPolled) {
+		if err := app.PullConfig(context.Background()); err != nil {
+			log.Println("Error pulling node config:", err)
+		}
+		time.Sleep(app.conf().ConfigPollInterval())
+	}
+}
+
+// PullConfig fetches the node config, an unchanged ETag or version is not applied again.
+func (app *App) PullConfig(ctx context.Context) error {
+	urls := app.conf().ConfigUrls()
+	if !app.conf().Managed() || len(urls) == 0 {
+		return nil
+	}
+	rc := app.remote
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	header := http.Header{}
+	if rc.etag != "" {
+		header.Set("If-None-Match", rc.etag)
+	}
+	resp, _, err := app.managerDoAny(ctx, urls, http.MethodGet, nil, header)
+	if err != nil {
+		return err
+	}
+	if resp.status == http.StatusNotModified {
+		return nil
+	}
+	nc := &schema.NodeConfig{}
+	if err := json.Unmarshal(resp.body, nc); err != nil {
+		return fmt.Errorf("decoding node config: %w", err)
+	}
+	rc.etag = resp.header.Get("ETag")
+	if nc.Version != "" && nc.Version == rc.version {
+		return nil
+	}
+	app.reloadMu.Lock()
+	app.applyNodeConfig(nc)
+	rc.last.Store(nc)
+	app.reloadMu.Unlock()
+	rc.version = nc.Version
+	return nil
+}
+
+// applyNodeConfig applies the manager's node config live, sessions keep running
+// except the ones of users that are no longer allowed. The caller holds reloadMu.
+func (app *App) applyNodeConfig(nc *schema.NodeConfig) {
+	c := *app.conf()
+	changed := make([]string, 0)
+	if len(nc.SubAddresses) > 0 {
+		if v := strings.Join(nc.SubAddresses, ","); v != c.SubAddresses {
+			c.SubAddresses = v
+			changed = append(changed, "sub_addresses")
+		}
+	}
+	if nc.LogLevel != "" && !strings.EqualFold(nc.LogLevel, c.DebugLevel) {
+		c.DebugLevel = nc.LogLevel
+		slog.SetLogLoggerLevel(c.LogLevel())
+		changed = append(changed, "log_level")
+	}
+	if nc.PushIntervalSecond > 0 && strconv.Itoa(nc.PushIntervalSecond) != c.IntervalSecond {
+		c.IntervalSecond = strconv.Itoa(nc.PushIntervalSecond)
+		changed = append(changed, "push_interval")
+	}
+	app.cfg.Store(&c)
+	if nc.Routing != "" && nc.Routing != app.nodeRouting {
+		prev := app.nodeRouting
+		app.nodeRouting = nc.Routing
+		if err := app.loadRouting(); err != nil {
+			app.nodeRouting = prev
+			log.Println("Error applying the manager's routing rules, the old ones are kept:", err)
+		} else {
+			changed = append(changed, "routing")
+		}
+	}
+	if nc.Users != nil {
+		app.users.replaceSource(userSourceManager, managedUsers(nc.Users))
+		app.enforceUsers()
+		app.saveUserCache()
+		changed = append(changed, "users")
+	}
+	select {
+	case app.reconfigured <- struct{}{}:
+	default:
+	}
+	slog.Info("node config applied", "version", nc.Version, "changed", changed)
+}
+
+// managedUsers converts the users of the manager, users with an invalid UUID or ACL are skipped.
+func managedUsers(nus []schema.NodeUser) []User {
+	users := make([]User, 0, len(nus))
+	for _, nu := range nus {
+		uid, ok := normalizeUID(nu.UID)
+		if !ok {
+			slog.Warn("manager: invalid user uuid", "uid", nu.UID)
+			continue
+		}
+		u := User{UID: uid, Enabled: !nu.Disabled, QuotaKb: max(nu.QuotaKb, 0), MaxSessions: max(nu.MaxSessions, 0), Outbound: nu.Outbound, SockOpt: nu.SockOpt}
+		if err := u.setACL(nu.ACL); err != nil {
+			slog.Warn("manager: invalid user acl, user skipped", "uid", uid, "err", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users
+}
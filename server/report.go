@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/unchainese/unchain/global"
+)
+
+// usageReport is a usage snapshot sent to the manager, it is retried with the same ID until acknowledged.
+type usageReport struct {
+	ID        string                  `json:"id"`
+	CreatedAt time.Time               `json:"created_at"`
+	Usage     map[string]trafficUsage `json:"usage"` //bytes, whole KB only
+
+	Detections map[string]map[string]int64 `json:"detections,omitempty"` //user -> protocol -> sessions
+}
+
+func newUsageReport(snapshot map[string]trafficUsage, detections map[string]map[string]int64) *usageReport {
+	usage := make(map[string]trafficUsage, len(snapshot))
+	for uid, u := range snapshot {
+		up, down := u.Kb()
+		up, down = max(up, 0), max(down, 0)
+		if up == 0 && down == 0 {
+			continue
+		}
+		usage[uid] = trafficUsage{Up: up << 10, Down: down << 10}
+	}
+	return &usageReport{ID: uuid.NewString(), CreatedAt: time.Now(), Usage: usage, Detections: detections}
+}
+
+// reporter serializes the pushes to the manager and holds the reports not acknowledged yet.
+type reporter struct {
+	mu      sync.Mutex
+	pending []*usageReport //oldest first
+	lastID  string         //last acknowledged report, persisted in the state file
+	failed  chan struct{}  //signals loopPush to retry with backoff
+}
+
+func (app *App) spoolFile(r *usageReport) string {
+	return filepath.Join(app.conf().SpoolDir, fmt.Sprintf("report-%d-%s.json", r.CreatedAt.UnixNano(), r.ID))
+}
+
+func (app *App) spoolReport(r *usageReport) error {
+	if app.conf().SpoolDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(app.conf().SpoolDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return global.WriteFileAtomic(app.spoolFile(r), data)
+}
+
+// loadSpool reloads the reports that were not acknowledged before the node stopped.
+func (app *App) loadSpool() error {
+	if app.conf().SpoolDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(app.conf().SpoolDir, "report-*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	rp := app.reporter
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		r := &usageReport{}
+		if err := json.Unmarshal(data, r); err != nil {
+			log.Println("Error decoding spooled report, removed:", file, err)
+			os.Remove(file)
+			continue
+		}
+		if r.ID == rp.lastID {
+			// acknowledged already, the node stopped before the spool file was removed
+			os.Remove(file)
+			continue
+		}
+		rp.pending = append(rp.pending, r)
+	}
+	if len(rp.pending) > 0 {
+		slog.Info("unacknowledged usage reports restored", "dir", app.conf().SpoolDir, "reports", len(rp.pending))
+	}
+	return nil
+}
+
+// PushNode reports the usage to the manager and refreshes the users it returns.
+// A report is removed from the traffic meter only once the manager acknowledged it,
+// a failed report is kept in the spool and retried with the same idempotency key.
+func (app *App) PushNode() error {
+	urls := app.conf().RegisterUrls()
+	if !app.conf().Managed() || len(urls) == 0 {
+		return nil
+	}
+	rp := app.reporter
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if len(rp.pending) == 0 {
+		rp.pending = append(rp.pending, app.newSpooledReport())
+	}
+	for len(rp.pending) > 0 {
+		r := rp.pending[0]
+		users, err := app.sendReport(urls, r)
+		if err != nil {
+			log.Println("Error registering:", err)
+			select {
+			case rp.failed <- struct{}{}:
+			default:
+			}
+			return err
+		}
+		app.ackReport(r)
+		rp.pending = rp.pending[1:]
+		if len(rp.pending) == 0 {
+			app.applyManagerUsers(users)
+		}
+	}
+	return nil
+}
+
+// newSpooledReport snapshots the meter into a report. The state is checkpointed before the report is spooled,
+// so a restart never restores a spooled report with less unreported usage than it carries.
+func (app *App) newSpooledReport() *usageReport {
+	app.stateMu.Lock()
+	defer app.stateMu.Unlock()
+	r := newUsageReport(app.meter.snapshot(), app.detections.snapshot())
+	if err := app.saveStateLocked(); err != nil {
+		log.Println("Error saving traffic state:", err)
+	}
+	if err := app.spoolReport(r); err != nil {
+		log.Println("Error spooling report:", err)
+	}
+	return r
+}
+
+func (app *App) sendReport(urls []string, r *usageReport) (map[string]int64, error) {
+	args := app.statOf(r.Usage)
+	args.ReportID = r.ID
+	args.Detections = r.Detections
+	body, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+	header := http.Header{}
+	header.Set("Idempotency-Key", r.ID)
+	resp, _, err := app.managerDoAny(context.Background(), urls, http.MethodPost, body, header)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]int64)
+	err = json.Unmarshal(resp.body, &users)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return users, nil
+}
+
+// ackReport removes the acknowledged usage from the meter, bytes counted during the request are kept.
+func (app *App) ackReport(r *usageReport) {
+	app.stateMu.Lock()
+	for uid, u := range r.Usage {
+		app.meter.sub(uid, u.Up, u.Down)
+		app.users.subUsed(userSourceManager, uid, u.Up+u.Down)
+	}
+	app.detections.sub(r.Detections)
+	app.reporter.lastID = r.ID
+	err := app.saveStateLocked()
+	app.stateMu.Unlock()
+	if err != nil {
+		log.Println("Error saving traffic state:", err)
+	}
+	if app.conf().SpoolDir != "" {
+		if err := os.Remove(app.spoolFile(r)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error removing spooled report:", err)
+		}
+	}
+}
+
+func (app *App) applyManagerUsers(users map[string]int64) {
+	if app.conf().ConfigUrl != "" {
+		// the pulled node config owns the user list, the push only refreshes the available traffic
+		for k, userAvailableKB := range users {
+			app.users.update(strings.ToLower(k), func(u *User) {
+				if u.Source == userSourceManager {
+					u.QuotaKb = max(userAvailableKB, 0)
+				}
+			})
+		}
+		app.enforceUsers()
+		app.saveUserCache()
+		return
+	}
+	managed := make([]User, 0, len(users))
+	for k, userAvailableKB := range users {
+		slog.Debug("user available traffic", "uid", k, "available", userAvailableKB)
+		managed = append(managed, User{UID: strings.ToLower(k), Enabled: true, QuotaKb: max(userAvailableKB, 0)}) //set allowed userID
+	}
+	app.users.replaceSource(userSourceManager, managed)
+	app.enforceUsers()
+	app.saveUserCache()
+}
+
+const pushRetryMin = 2 * time.Second
+
+// nextBackoff doubles the retry delay, capped at the push interval.
+func nextBackoff(cur, limit time.Duration) time.Duration {
+	next := min(max(cur*2, pushRetryMin), limit, 5*time.Minute)
+	return max(next, pushRetryMin)
+}
+
+func (app *App) loopPush() {
+	if !app.conf().Managed() {
+		return
+	}
+	backoff := time.Duration(0)
+	tk := time.NewTimer(app.conf().PushInterval())
+	defer tk.Stop()
+	for {
+		select {
+		case sig := <-app.exitSignal:
+			app.exitSignal <- sig
+			app.PushNode() //last push
+			return
+		case <-app.reporter.failed:
+			backoff = nextBackoff(backoff, app.conf().PushInterval())
+			log.Println("push to manager failed, retry in", backoff)
+			tk.Reset(backoff)
+		case <-app.reconfigured:
+			if backoff == 0 {
+				tk.Reset(app.conf().PushInterval())
+			}
+		case <-tk.C:
+			if app.PushNode() == nil {
+				backoff = 0
+				tk.Reset(app.conf().PushInterval())
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unchainese/unchain/outbound"
+	"github.com/unchainese/unchain/routing"
+	"github.com/unchainese/unchain/schema"
+)
+
+var errRouteBlocked = errors.New("destination blocked by routing")
+
+const (
+	inboundVLESS      = "vless"
+	directDialTimeout = time.Second
+)
+
+// routeTable is the router and the dialers of its outbounds, replaced as a whole on reload.
+type routeTable struct {
+	router  *routing.Router
+	dialers map[string]outbound.Dialer
+	direct  outbound.Dialer
+	groups  []*outbound.Group
+	stop    context.CancelFunc //stops the probes of the groups
+	limits  sync.Map           //"rule/user" -> *rateLimit of the rate limited rules
+	pruned  atomic.Int64       //unix time the idle limits were last removed
+}
+
+// dialer returns the dialer of the outbound, a session routed before a reload removed its outbound goes direct.
+func (rt *routeTable) dialer(tag string) outbound.Dialer {
+	if d, ok := rt.dialers[tag]; ok {
+		return d
+	}
+	slog.Warn("outbound removed by a reload, going direct", "outbound", tag)
+	return rt.direct
+}
+
+// loadRouting compiles the RoutingFile, without one every session goes direct.
+// On error the current routes are kept.
+func (app *App) loadRouting() error {
+	rc := &routing.Config{}
+	file := app.conf().RoutingFile
+	var err error
+	if app.nodeRouting != "" {
+		dir := "."
+		if file != "" {
+			dir = filepath.Dir(file)
+		}
+		if rc, err = routing.Parse(app.nodeRouting, dir); err != nil {
+			return fmt.Errorf("manager routing rules: %w", err)
+		}
+	} else if file != "" {
+		if rc, err = routing.LoadFile(file); err != nil {
+			return err
+		}
+	}
+	r, err := routing.New(rc)
+	if err != nil {
+		return err
+	}
+	old := app.routes.Load()
+	rt := &routeTable{router: r, dialers: make(map[string]outbound.Dialer), direct: &directDialer{app: app}}
+	groups := make([]routing.OutboundConfig, 0)
+	for _, oc := range r.Outbounds() {
+		switch oc.Type {
+		case routing.OutboundDirect:
+			rt.dialers[oc.Tag] = rt.direct
+			if oc.Tag != routing.OutboundDirect {
+				rt.dialers[oc.Tag] = &directDialer{app: app, opt: oc.SockOpt}
+			}
+		case routing.OutboundIPPool:
+			if d, ok := old.kept(oc); ok {
+				rt.dialers[oc.Tag] = d
+				continue
+			}
+			d, err := newPoolDialer(app, oc)
+			if err != nil {
+				return err
+			}
+			rt.dialers[oc.Tag] = d
+		case routing.OutboundBlock:
+			rt.dialers[oc.Tag] = blockDialer{}
+		case routing.OutboundGroup:
+			groups = append(groups, oc)
+		default:
+			if d, ok := old.kept(oc); ok {
+				rt.dialers[oc.Tag] = d
+				continue
+			}
+			d, err := outbound.New(oc)
+			if err != nil {
+				return err
+			}
+			rt.dialers[oc.Tag] = d
+		}
+	}
+	for _, oc := range groups {
+		g, err := outbound.NewGroup(oc, rt.dialers)
+		if err != nil {
+			return err
+		}
+		rt.groups = append(rt.groups, g)
+	}
+	for _, g := range rt.groups {
+		rt.dialers[g.Tag()] = g
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	rt.stop = stop
+	for _, g := range rt.groups {
+		go g.Run(ctx)
+	}
+	app.routes.Store(rt)
+	if old != nil {
+		old.stop()
+		old.close(rt)
+	}
+	return nil
+}
+
+// kept returns the dialer of an outbound the reload did not change, so a wireguard tunnel and its sessions survive it.
+func (rt *routeTable) kept(oc routing.OutboundConfig) (outbound.Dialer, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	if prev, ok := rt.router.Outbound(oc.Tag); !ok || !reflect.DeepEqual(prev, oc) {
+		return nil, false
+	}
+	d, ok := rt.dialers[oc.Tag]
+	return d, ok
+}
+
+// close releases the dialers next no longer uses.
+func (rt *routeTable) close(next *routeTable) {
+	for tag, d := range rt.dialers {
+		c, ok := d.(io.Closer)
+		if !ok || next.dialers[tag] == d {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			slog.Warn("closing outbound", "outbound", tag, "err", err)
+		}
+	}
+}
+
+// groupStats returns the state of the outbound groups, nil without groups.
+func (app *App) groupStats() []schema.OutboundGroup {
+	rt := app.routes.Load()
+	if len(rt.groups) == 0 {
+		return nil
+	}
+	res := make([]schema.OutboundGroup, 0, len(rt.groups))
+	for _, g := range rt.groups {
+		res = append(res, g.Stat())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Tag < res[j].Tag })
+	return res
+}
+
+// routeSession picks the outbound of the session from the destination, the user and the sniffed first payload.
+// The outbound of the user replaces the default one for the sessions no rule matches.
+func (app *App) routeSession(sess *session, sv *schema.ProtoVLESS) {
+	payload := sv.DataTcp()
+	if sv.DstProtocol == "udp" {
+		payload = sv.DataUdp()
+	}
+	meta := &routing.Metadata{
+		Network: sv.DstProtocol,
+		Host:    sv.Host(),
+		Port:    sv.Port(),
+		User:    sess.uid,
+		Inbound: inboundVLESS,
+		Lookup:  lookupRouteIPs,
+	}
+	meta.Protocol, meta.SniffedHost = routing.Sniff(sv.DstProtocol, sv.Port(), payload)
+	rt := app.routes.Load()
+	tag, rule := rt.router.Route(meta)
+	if u, ok := app.users.get(sess.uid); ok && rule == 0 && u.Outbound != "" {
+		if _, ok := rt.dialers[u.Outbound]; ok {
+			tag = u.Outbound
+		} else {
+			slog.Warn("user outbound is not defined, using the default", "userID", sess.uid, "outbound", u.Outbound)
+		}
+	}
+	sess.outbound, sess.sniffed = tag, meta.Protocol
+	if kbps := rt.router.RateLimit(rule); kbps > 0 {
+		sess.limit = rt.limit(rule, sess.uid, kbps)
+	}
+	if detectedProtocols[meta.Protocol] {
+		c := app.conf()
+		app.detections.add(sess.uid, meta.Protocol, c.Managed() && c.ReportProtocolDetections())
+		slog.Info("protocol detected", "userID", sess.uid, "dst", sess.dst, "protocol", meta.Protocol, "rule", rule, "outbound", tag, "rateLimitKBps", rt.router.RateLimit(rule))
+	}
+	slog.Debug("session routed", "userID", sess.uid, "dst", sess.dst, "protocol", meta.Protocol, "host", meta.SniffedHost, "rule", rule, "outbound", tag)
+}
+
+func lookupRouteIPs(host string) []netip.Addr {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		slog.Debug("routing lookup failed", "host", host, "err", err)
+		return nil
+	}
+	return ips
+}
+
+// directDialer dials the destination addresses the ACL allows for the user, never the name itself,
+// with the socket options of the outbound and the user.
+type directDialer struct {
+	app *App
+	opt schema.SockOpt
+}
+
+func (d *directDialer) Dial(ctx context.Context, req *outbound.Request) (net.Conn, error) {
+	return d.app.dialDirect(ctx, req, d.opt, nil)
+}
+
+// dialDirect dials the destination addresses the ACL allows for the user with the options of the outbound and the user,
+// source picks the source address for a destination address when it is not nil.
+func (app *App) dialDirect(ctx context.Context, req *outbound.Request, opt schema.SockOpt, source func(dst netip.Addr) (netip.Addr, error)) (net.Conn, error) {
+	ips, err := app.resolveDst(ctx, req, directDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := app.users.get(req.User); ok {
+		opt = mergeSockOpt(opt, u.SockOpt)
+	}
+	errs := make([]error, 0)
+	for _, ip := range ips {
+		o := opt
+		if source != nil {
+			src, err := source(ip)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			o.BindIP = src.String()
+		}
+		conn, err := dialDst(ctx, req.Network, netip.AddrPortFrom(ip, req.Port), o)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("connecting to destination: %w", errors.Join(errs...))
+}
+
+type blockDialer struct{}
+
+func (blockDialer) Dial(_ context.Context, req *outbound.Request) (net.Conn, error) {
+	return nil, fmt.Errorf("%w: %s", errRouteBlocked, req.Addr())
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is a live VLESS tunnel, cancelling it closes the WebSocket and the destination connection.
+type session struct {
+	id       uint64
+	uid      string
+	network  string
+	dst      string
+	outbound string     //tag of the outbound the session was routed to
+	sniffed  string     //protocol sniffed from the first payload
+	limit    *rateLimit //of the matched rule, nil for unlimited
+	startAt  time.Time
+	cancel   context.CancelFunc
+
+	up   atomic.Int64 //client -> destination bytes
+	down atomic.Int64 //destination -> client bytes
+
+	flushMu     sync.Mutex
+	flushedUp   int64
+	flushedDown int64
+}
+
+// protocol names the session kind in the node telemetry.
+func (s *session) protocol() string {
+	return "vless-" + s.network
+}
+
+// flush returns the bytes counted since the previous flush.
+func (s *session) flush() (up, down int64) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	u, d := s.up.Load(), s.down.Load()
+	up, down = u-s.flushedUp, d-s.flushedDown
+	s.flushedUp, s.flushedDown = u, d
+	return up, down
+}
+
+// sessionRegistry tracks the live sessions by user so they can be kicked when the user is revoked.
+type sessionRegistry struct {
+	mu     sync.Mutex
+	seq    uint64
+	byUser map[string]map[uint64]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{byUser: make(map[string]map[uint64]*session)}
+}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	s.id = r.seq
+	if r.byUser[s.uid] == nil {
+		r.byUser[s.uid] = make(map[uint64]*session)
+	}
+	r.byUser[s.uid][s.id] = s
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byUser[s.uid], s.id)
+	if len(r.byUser[s.uid]) == 0 {
+		delete(r.byUser, s.uid)
+	}
+}
+
+func (r *sessionRegistry) all() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*session, 0)
+	for _, m := range r.byUser {
+		for _, s := range m {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (r *sessionRegistry) userIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.byUser))
+	for uid := range r.byUser {
+		ids = append(ids, uid)
+	}
+	return ids
+}
+
+// kick cancels all the live sessions of the user and returns how many were cancelled.
+func (r *sessionRegistry) kick(uid string) int {
+	r.mu.Lock()
+	sessions := make([]*session, 0, len(r.byUser[uid]))
+	for _, s := range r.byUser[uid] {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+	for _, s := range sessions {
+		s.cancel()
+	}
+	return len(sessions)
+}
+
+// enforceUsers kicks the live sessions of users that are removed, disabled or over quota.
+func (app *App) enforceUsers() {
+	for _, uid := range app.sessions.userIDs() {
+		if app.IsUserNotAllowed(uid) {
+			n := app.sessions.kick(uid)
+			slog.Info("user revoked, sessions kicked", "uid", uid, "sessions", n)
+		}
+	}
+}
+
+// flushSession moves the bytes counted by the session into the traffic meter.
+func (app *App) flushSession(s *session) {
+	up, down := s.flush()
+	app.telemetry.up.Add(up)
+	app.telemetry.down.Add(down)
+	if up != 0 || down != 0 {
+		app.trafficInc(s.uid, s.dst, up, down)
+		app.checkOverQuota(s.uid)
+	}
+}
+
+const sessionFlushInterval = 5 * time.Second
+
+// loopSessions meters long-lived sessions periodically, so quota is enforced while they are still running.
+func (app *App) loopSessions() {
+	tk := time.NewTicker(sessionFlushInterval)
+	defer tk.Stop()
+	for now := range tk.C {
+		for _, s := range app.sessions.all() {
+			app.flushSession(s)
+		}
+		app.telemetry.tick(now)
+		app.enforceUsers()
+	}
+}
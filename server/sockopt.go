@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+// mergeSockOpt returns the options of the outbound with the fields the user sets replacing them.
+func mergeSockOpt(base schema.SockOpt, user *schema.SockOpt) schema.SockOpt {
+	if user == nil {
+		return base
+	}
+	if user.BindIP != "" {
+		base.BindIP = user.BindIP
+	}
+	if user.Interface != "" {
+		base.Interface = user.Interface
+	}
+	if user.Mark != 0 {
+		base.Mark = user.Mark
+	}
+	if user.KeepAlive != 0 {
+		base.KeepAlive = user.KeepAlive
+	}
+	if user.FastOpen {
+		base.FastOpen = true
+	}
+	if user.NoDelay != nil {
+		base.NoDelay = user.NoDelay
+	}
+	return base
+}
+
+// dialDst connects to a destination address with the socket options, every direct connection goes through it.
+func dialDst(ctx context.Context, network string, dst netip.AddrPort, opt schema.SockOpt) (net.Conn, error) {
+	d := net.Dialer{Timeout: directDialTimeout, Control: sockControl(opt)}
+	if opt.BindIP != "" {
+		ip, err := netip.ParseAddr(opt.BindIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind_ip %q", opt.BindIP)
+		}
+		ip = ip.Unmap()
+		if ip.Is4() != dst.Addr().Is4() {
+			return nil, fmt.Errorf("bind_ip %s can not reach %s", ip, dst.Addr())
+		}
+		if network == "udp" {
+			d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+		} else {
+			d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+		}
+	}
+	if opt.KeepAlive < 0 {
+		d.KeepAlive = -1
+	} else if opt.KeepAlive > 0 {
+		every := time.Duration(opt.KeepAlive) * time.Second
+		d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: every, Interval: every}
+	}
+	conn, err := d.DialContext(ctx, network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok && opt.NoDelay != nil {
+		if err := tc.SetNoDelay(*opt.NoDelay); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("setting TCP_NODELAY: %w", err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/unchainese/unchain/schema"
+	"golang.org/x/sys/unix"
+)
+
+// sockControl sets the options that need the socket before it connects, nil when there are none.
+func sockControl(opt schema.SockOpt) func(network, address string, c syscall.RawConn) error {
+	if opt.Interface == "" && opt.Mark == 0 && !opt.FastOpen {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if opt.Interface != "" {
+				if err := unix.BindToDevice(int(fd), opt.Interface); err != nil {
+					serr = errors.Join(serr, fmt.Errorf("binding to %s: %w", opt.Interface, err))
+				}
+			}
+			if opt.Mark != 0 {
+				if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, opt.Mark); err != nil {
+					serr = errors.Join(serr, fmt.Errorf("setting SO_MARK: %w", err))
+				}
+			}
+			if opt.FastOpen && strings.HasPrefix(network, "tcp") {
+				if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+					serr = errors.Join(serr, fmt.Errorf("setting TCP_FASTOPEN_CONNECT: %w", err))
+				}
+			}
+		})
+		return errors.Join(err, serr)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+var errSockOptUnsupported = errors.New("interface, mark and tcp_fast_open are only supported on linux")
+
+// sockControl fails the connections asking for the Linux only options, so they never leave from the wrong place.
+func sockControl(opt schema.SockOpt) func(network, address string, c syscall.RawConn) error {
+	if opt.Interface == "" && opt.Mark == 0 && !opt.FastOpen {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errSockOptUnsupported
+	}
+}
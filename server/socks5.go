@@ -11,8 +11,7 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/unchainese/unchain/schema"
+	"github.com/unchainese/unchain/outbound"
 )
 
 // SOCKS5 protocol and server constants
@@ -210,70 +209,22 @@ func handleRelay(client net.Conn, request *socks5Request) error {
 	}
 }
 
-type targetWs struct {
-	conn        *websocket.Conn
-	isFirstRead bool
-}
-
-func makeTargetWs(addr, uid string, req *socks5Request) (*targetWs, error) {
-	target, _, err := websocket.DefaultDialer.Dial(addr, nil)
+// dialVLESS opens the request on the VLESS server the client relays to.
+func dialVLESS(req *socks5Request) (net.Conn, error) {
+	d, err := outbound.NewVLESSURL(wsURL, vlessUUID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to target %s: %v", addr, err)
+		return nil, err
 	}
-	udpOrTcp := "tcp"
+	network := networkTCP
 	if req.command == cmdUDPAssociate {
-		udpOrTcp = "udp"
-	}
-	vlessHeadData := schema.MakeVless(uid, req.address, req.port, udpOrTcp, nil).DataHeader()
-	err = target.WriteMessage(websocket.BinaryMessage, vlessHeadData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send VLESS header: %w", err)
-	}
-	return &targetWs{conn: target, isFirstRead: true}, nil
-}
-
-func (t *targetWs) Read(p []byte) (n int, err error) {
-	_, bytesRead, err := t.conn.ReadMessage()
-	if err != nil {
-		return 0, err
-	}
-	if len(bytesRead) > 2 && t.isFirstRead {
-		// Handle the first read case
-		t.isFirstRead = false
-		bytesRead = bytesRead[2:] // Skip the first two bytes
-	}
-	return copy(p, bytesRead), nil
-}
-
-func (t *targetWs) NextRead(p []byte) (n int, err error) {
-	t.conn.NextReader()
-	_, bytesRead, err := t.conn.ReadMessage()
-	if err != nil {
-		return 0, err
-	}
-	if len(bytesRead) > 2 && t.isFirstRead {
-		// Handle the first read case
-		t.isFirstRead = false
-		bytesRead = bytesRead[2:] // Skip the first two bytes
-	}
-	return copy(p, bytesRead), nil
-}
-
-func (t *targetWs) Write(p []byte) (n int, err error) {
-	err = t.conn.WriteMessage(websocket.BinaryMessage, p)
-	if err != nil {
-		return 0, err
+		network = networkUDP
 	}
-	return len(p), nil
-}
-
-func (t *targetWs) Close() error {
-	return t.conn.Close()
+	return d.Dial(context.Background(), &outbound.Request{Network: network, Host: req.address, Port: req.port})
 }
 
 func handleTCPRelay(client net.Conn, request *socks5Request) error {
 	// Connect to target
-	target, err := makeTargetWs(wsURL, vlessUUID, request)
+	target, err := dialVLESS(request)
 	if err != nil {
 		// Send failure response
 		response := []byte{socksVersion5, replyHostUnreachable, reservedField, addrTypeIPv4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
@@ -495,22 +446,21 @@ func forwardUDPPacket(udpListener *net.UDPConn, clientAddr *net.UDPAddr, targetA
 		return fmt.Errorf("failed to resolve target address: %v", err)
 	}
 	req := &socks5Request{command: cmdUDPAssociate, address: addr.AddrPort().Addr().String(), port: addr.AddrPort().Port()}
-	ws, err := makeTargetWs(wsURL, vlessUUID, req)
+	ws, err := dialVLESS(req)
 	if err != nil {
 		return fmt.Errorf("failed to connect to target %v websocket: %w", addr, err)
 	}
 	defer ws.Close()
 
-	udpData := vlessUdpDataMake(data)
-	if _, err := ws.Write(udpData); err != nil {
+	if _, err := ws.Write(data); err != nil {
 		return fmt.Errorf("failed to write to target websocket: %w", err)
 	}
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancelFunc()
 
 	responseBuffer := make([]byte, maxUDPPacketSize)
+readLoop:
 	for {
-		//todo read websocket has a bug
 		select {
 
 		case <-ctx.Done():
@@ -518,7 +468,6 @@ func forwardUDPPacket(udpListener *net.UDPConn, clientAddr *net.UDPAddr, targetA
 
 		default:
 			// Read response from ws
-			responseBuffer := make([]byte, maxUDPPacketSize)
 			n, err := ws.Read(responseBuffer)
 			if err != nil {
 				if err == io.EOF {
@@ -529,7 +478,7 @@ func forwardUDPPacket(udpListener *net.UDPConn, clientAddr *net.UDPAddr, targetA
 			}
 			if n > 0 {
 				responseBuffer = responseBuffer[:n]
-				break
+				break readLoop
 			}
 		}
 	}
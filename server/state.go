@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/unchainese/unchain/global"
+)
+
+const stateVersion = 1
+
+// nodeState is the on-disk checkpoint of the traffic meter.
+// Unreported is the usage not acknowledged by the manager yet, the next push sends exactly this delta.
+// LastReportID is the last acknowledged report, a spooled report with this ID is not sent again.
+type nodeState struct {
+	Version      int                     `json:"version"`
+	SavedAt      time.Time               `json:"saved_at"`
+	Unreported   map[string]trafficUsage `json:"unreported"`
+	LastReportID string                  `json:"last_report_id,omitempty"`
+}
+
+// saveState checkpoints the unreported usage to the state file.
+func (app *App) saveState() error {
+	app.stateMu.Lock()
+	defer app.stateMu.Unlock()
+	return app.saveStateLocked()
+}
+
+// saveStateLocked is saveState with app.stateMu held by the caller.
+func (app *App) saveStateLocked() error {
+	file := app.conf().StateFile
+	if file == "" {
+		return nil
+	}
+	st := nodeState{
+		Version:      stateVersion,
+		SavedAt:      time.Now(),
+		Unreported:   app.meter.snapshot(),
+		LastReportID: app.reporter.lastID,
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return global.WriteFileAtomic(file, data)
+}
+
+// loadState adds the unreported usage of the previous run to the traffic meter.
+func (app *App) loadState() error {
+	file := app.conf().StateFile
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st := nodeState{}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("decoding state file %s: %w", file, err)
+	}
+	if st.Version != stateVersion {
+		return fmt.Errorf("state file %s has unsupported version %d", file, st.Version)
+	}
+	for uid, u := range st.Unreported {
+		app.meter.add(uid, u.Up, u.Down)
+	}
+	app.reporter.lastID = st.LastReportID
+	slog.Info("traffic state restored", "file", file, "users", len(st.Unreported), "saved_at", st.SavedAt)
+	return nil
+}
+
+// checkpoint saves the traffic state and the usage history.
+func (app *App) checkpoint() {
+	if err := app.saveState(); err != nil {
+		log.Println("Error saving traffic state:", err)
+	}
+	if app.conf().HistoryFile != "" {
+		if err := app.history.save(app.conf().HistoryFile); err != nil {
+			log.Println("Error saving usage history:", err)
+		}
+	}
+}
+
+// loopCheckpoint saves the traffic state periodically, a crash loses at most one interval of usage.
+func (app *App) loopCheckpoint() {
+	tk := time.NewTicker(app.conf().CheckpointInterval())
+	defer tk.Stop()
+	for range tk.C {
+		app.checkpoint()
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+// the manager sends a ping at least this often, a quieter stream is reconnected
+const streamIdleTimeout = 90 * time.Second
+
+var streamClient = &http.Client{} //no timeout, the stream stays open
+
+type sseEvent struct {
+	id    string
+	event string
+	data  []byte
+	sig   string
+}
+
+// readSSE calls fn for each event of a text/event-stream body until it fails or ends.
+func readSSE(sc *bufio.Scanner, fn func(ev sseEvent) error) error {
+	ev := sseEvent{}
+	data := make([]string, 0)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if len(data) > 0 || ev.event != "" {
+				ev.data = []byte(strings.Join(data, "\n"))
+				if err := fn(ev); err != nil {
+					return err
+				}
+			}
+			ev, data = sseEvent{}, data[:0]
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue //comment
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			ev.id = value
+		case "event":
+			ev.event = value
+		case "data":
+			data = append(data, value)
+		case "sig":
+			ev.sig = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed by manager")
+}
+
+// loopStream keeps the real-time user channel to the manager open, to the first healthy StreamUrl,
+// until a reload removes StreamUrl.
+// Events missed while the channel is down are caught up by an immediate push and config pull,
+// the periodic PushNode keeps running either way.
+func (app *App) loopStream() {
+	backoff := time.Duration(0)
+	for keepLooping(&app.streamLoop, app.streamed) {
+		start := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		app.streamMu.Lock()
+		urls := app.endpoints.order(app.conf().StreamUrls())
+		app.streamCancel = cancel
+		app.streamMu.Unlock()
+		if len(urls) == 0 {
+			cancel()
+			continue
+		}
+		err := app.stream(ctx, urls[0])
+		reconnect := ctx.Err() != nil
+		cancel()
+		log.Println("manager stream disconnected:", err)
+		app.resync()
+		if reconnect {
+			continue //closed by a reload, connect to the new endpoints right away
+		}
+		if time.Since(start) > time.Minute {
+			backoff = 0
+		}
+		backoff = min(max(backoff*2, time.Second), time.Minute)
+		time.Sleep(backoff)
+	}
+}
+
+// restartStream closes the manager stream, the loop reconnects with the current config.
+func (app *App) restartStream() {
+	app.streamMu.Lock()
+	defer app.streamMu.Unlock()
+	if app.streamCancel != nil {
+		app.streamCancel()
+	}
+}
+
+// resync fetches the users from the manager after the stream may have missed events.
+func (app *App) resync() {
+	go func() {
+		app.PushNode()
+		if err := app.PullConfig(context.Background()); err != nil {
+			log.Println("Error pulling node config:", err)
+		}
+	}()
+}
+
+func (app *App) stream(ctx context.Context, url string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	header := http.Header{}
+	header.Set("Accept", "text/event-stream")
+	req, nonce, err := app.newManagerRequest(ctx, http.MethodGet, url, nil, header)
+	if err != nil {
+		return err
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		app.endpoints.failure(url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("manager responded %s", resp.Status)
+		app.endpoints.failure(url, err)
+		return err
+	}
+	app.endpoints.success(url)
+	slog.Info("manager stream connected", "url", url)
+	app.resync() //catch up with what happened while disconnected
+
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+	lastID := int64(-1)
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), managerMaxBody)
+	return readSSE(sc, func(ev sseEvent) error {
+		idle.Reset(streamIdleTimeout)
+		if app.conf().ManagerSigned() {
+			if err := schema.VerifyEvent(app.conf().RegisterToken, nonce, ev.id, ev.event, ev.data, ev.sig); err != nil {
+				return fmt.Errorf("event %s rejected: %w", ev.id, err)
+			}
+			id, err := strconv.ParseInt(ev.id, 10, 64)
+			if err != nil || id <= lastID {
+				return fmt.Errorf("event id %q out of order", ev.id)
+			}
+			lastID = id
+		}
+		return app.applyStreamEvent(ev)
+	})
+}
+
+func (app *App) applyStreamEvent(ev sseEvent) error {
+	switch ev.event {
+	case schema.EventPing:
+	case schema.EventUsersUpsert:
+		nus := make([]schema.NodeUser, 0)
+		if err := json.Unmarshal(ev.data, &nus); err != nil {
+			return fmt.Errorf("decoding %s: %w", ev.event, err)
+		}
+		users := managedUsers(nus)
+		app.users.upsertSource(userSourceManager, users)
+		app.enforceUsers()
+		app.saveUserCache()
+		slog.Info("manager stream: users upserted", "users", len(users))
+	case schema.EventUsersRemove:
+		uids := make([]string, 0)
+		if err := json.Unmarshal(ev.data, &uids); err != nil {
+			return fmt.Errorf("decoding %s: %w", ev.event, err)
+		}
+		for i, uid := range uids {
+			uids[i] = strings.ToLower(uid)
+		}
+		n := app.users.removeSource(userSourceManager, uids)
+		app.enforceUsers()
+		app.saveUserCache()
+		slog.Info("manager stream: users removed", "users", n)
+	default:
+		slog.Debug("manager stream: unknown event", "event", ev.event)
+	}
+	return nil
+}
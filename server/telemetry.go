@@ -0,0 +1,104 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unchainese/unchain/schema"
+)
+
+// how many session flush ticks the dial error rate is computed over, one minute
+const dialRateTicks = int(time.Minute / sessionFlushInterval)
+
+type telemetrySample struct {
+	at         time.Time
+	up, down   int64
+	cpu        time.Duration
+	dials      int64
+	dialErrors int64
+}
+
+// telemetry measures the load of the node for the AppStat, it is sampled on every session flush tick.
+type telemetry struct {
+	startAt    time.Time
+	up         atomic.Int64 //all relayed bytes, metered or not
+	down       atomic.Int64
+	dials      atomic.Int64
+	dialErrors atomic.Int64
+
+	mu         sync.Mutex
+	samples    []telemetrySample //last dialRateTicks+1 samples, oldest first
+	upBps      int64
+	downBps    int64
+	cpuPercent float64
+}
+
+func newTelemetry() *telemetry {
+	t := &telemetry{startAt: time.Now()}
+	t.samples = append(t.samples, t.sample(t.startAt))
+	return t
+}
+
+// countDial counts a destination dial and whether it failed.
+func (t *telemetry) countDial(err error) {
+	t.dials.Add(1)
+	if err != nil {
+		t.dialErrors.Add(1)
+	}
+}
+
+func (t *telemetry) sample(now time.Time) telemetrySample {
+	return telemetrySample{
+		at:         now,
+		up:         t.up.Load(),
+		down:       t.down.Load(),
+		cpu:        processCPUTime(),
+		dials:      t.dials.Load(),
+		dialErrors: t.dialErrors.Load(),
+	}
+}
+
+// tick updates the throughput and CPU use since the previous tick.
+func (t *telemetry) tick(now time.Time) {
+	cur := t.sample(now)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.samples[len(t.samples)-1]
+	if elapsed := cur.at.Sub(prev.at); elapsed > 0 {
+		t.upBps = int64(float64(cur.up-prev.up) / elapsed.Seconds())
+		t.downBps = int64(float64(cur.down-prev.down) / elapsed.Seconds())
+		t.cpuPercent = float64(cur.cpu-prev.cpu) / float64(elapsed) * 100
+	}
+	t.samples = append(t.samples, cur)
+	if len(t.samples) > dialRateTicks+1 {
+		t.samples = t.samples[1:]
+	}
+}
+
+func (t *telemetry) load(sessions []*session) *schema.NodeLoad {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	res := &schema.NodeLoad{
+		UptimeSecond:       int64(time.Since(t.startAt).Seconds()),
+		Sessions:           int64(len(sessions)),
+		SessionsByProtocol: make(map[string]int64),
+		NumCPU:             runtime.NumCPU(),
+		MemorySys:          mem.Sys,
+		MemoryHeap:         mem.HeapAlloc,
+		Dials:              t.dials.Load(),
+		DialErrors:         t.dialErrors.Load(),
+	}
+	for _, s := range sessions {
+		res.SessionsByProtocol[s.protocol()]++
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res.UpBps, res.DownBps, res.CPUPercent = t.upBps, t.downBps, t.cpuPercent
+	oldest := t.samples[0]
+	if dials := res.Dials - oldest.dials; dials > 0 {
+		res.DialErrorRate = float64(res.DialErrors-oldest.dialErrors) / float64(dials)
+	}
+	return res
+}
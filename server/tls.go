@@ -0,0 +1,29 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync/atomic"
+)
+
+// certStore holds the TLS certificate of the app port, replaced on reload without a restart.
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func (s *certStore) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no tls certificate loaded")
+	}
+	return cert, nil
+}
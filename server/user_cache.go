@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/unchainese/unchain/global"
+)
+
+// userCache is the last user list received from the manager,
+// a node restarted while no manager answers keeps admitting these users.
+type userCache struct {
+	SavedAt time.Time `json:"saved_at"`
+	Users   []User    `json:"users"`
+}
+
+// saveUserCache writes the manager users, it is called whenever the manager changed them.
+func (app *App) saveUserCache() {
+	file := app.conf().UserCacheFile
+	if file == "" {
+		return
+	}
+	uc := userCache{SavedAt: time.Now(), Users: make([]User, 0)}
+	for _, u := range app.users.list() {
+		if u.Source == userSourceManager {
+			u.UsedBytes, u.Sessions = 0, 0
+			uc.Users = append(uc.Users, u)
+		}
+	}
+	data, err := json.Marshal(uc)
+	if err == nil {
+		err = global.WriteFileAtomic(file, data)
+	}
+	if err != nil {
+		log.Println("Error saving user cache:", err)
+	}
+}
+
+// loadUserCache restores the last known good manager users until the manager answers.
+func (app *App) loadUserCache() error {
+	file := app.conf().UserCacheFile
+	if file == "" || !app.conf().Managed() {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uc := userCache{}
+	if err := json.Unmarshal(data, &uc); err != nil {
+		return fmt.Errorf("decoding user cache %s: %w", file, err)
+	}
+	users := make([]User, 0, len(uc.Users))
+	for _, u := range uc.Users {
+		if err := u.setACL(u.ACL); err != nil {
+			slog.Warn("user cache: invalid user acl, user skipped", "uid", u.UID, "err", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	app.users.replaceSource(userSourceManager, users)
+	app.userCacheLoaded = true
+	slog.Info("manager users restored from cache", "users", len(users), "saved_at", uc.SavedAt.Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/unchainese/unchain/schema"
+)
+
+// where a user entry comes from, a push from the manager only replaces the users it owns
+const (
+	userSourceConfig  = "config"
+	userSourceManager = "manager"
+	userSourceAdmin   = "admin"
+)
+
+// User is an authorized VLESS user and its runtime limits.
+type User struct {
+	UID         string          `json:"uid"`
+	Source      string          `json:"source"`
+	Enabled     bool            `json:"enabled"`
+	QuotaKb     int64           `json:"quota_kb"`           //0 means unlimited
+	MaxSessions int64           `json:"max_sessions"`       //0 means unlimited
+	UsedBytes   int64           `json:"used_bytes"`         //used since the last reset, a manager user's until the manager acknowledged it
+	Sessions    int64           `json:"sessions"`           //active sessions
+	ACL         *schema.DstACL  `json:"acl,omitempty"`      //destination overrides of the node acl
+	Outbound    string          `json:"outbound,omitempty"` //routing outbound of the sessions no rule matches
+	SockOpt     *schema.SockOpt `json:"sockopt,omitempty"`  //socket options of the direct connections, over the outbound ones
+
+	acl *dstACL //compiled ACL
+}
+
+// setACL sets the destination overrides of the user, an invalid ACL leaves the user unchanged.
+func (u *User) setACL(acl *schema.DstACL) error {
+	var compiled *dstACL
+	if acl != nil {
+		var err error
+		if compiled, err = compileACL(*acl); err != nil {
+			return err
+		}
+	}
+	u.ACL, u.acl = acl, compiled
+	return nil
+}
+
+func (u User) overQuota() bool {
+	return u.QuotaKb > 0 && u.UsedBytes >= u.QuotaKb<<10
+}
+
+// userTable holds the users allowed to connect, it is safe for concurrent use.
+type userTable struct {
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+func newUserTable() *userTable {
+	return &userTable{users: make(map[string]*User)}
+}
+
+// normalizeUID returns the canonical lower case form of a UUID, the same form schema.ProtoVLESS.UUID returns.
+func normalizeUID(uid string) (string, bool) {
+	id, err := uuid.Parse(strings.TrimSpace(uid))
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+func (t *userTable) get(uid string) (User, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	u, ok := t.users[uid]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+func (t *userTable) list() []User {
+	t.mu.RLock()
+	res := make([]User, 0, len(t.users))
+	for _, u := range t.users {
+		res = append(res, *u)
+	}
+	t.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].UID < res[j].UID })
+	return res
+}
+
+// add adds a user, it returns false if the user exists already.
+func (t *userTable) add(u User) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.users[u.UID]; ok {
+		return false
+	}
+	t.users[u.UID] = &u
+	return true
+}
+
+func (t *userTable) remove(uid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.users[uid]
+	delete(t.users, uid)
+	return ok
+}
+
+// update applies fn to the user under the write lock, it returns false if the user does not exist.
+func (t *userTable) update(uid string, fn func(u *User)) (User, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[uid]
+	if !ok {
+		return User{}, false
+	}
+	fn(u)
+	return *u, true
+}
+
+// replaceSource replaces all the users of the given source,
+// users owned by another source are left untouched.
+func (t *userTable) replaceSource(source string, users []User) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keep := make(map[string]bool, len(users))
+	for _, u := range users {
+		keep[u.UID] = true
+	}
+	t.upsertLocked(source, users)
+	for uid, u := range t.users {
+		if u.Source == source && !keep[uid] {
+			delete(t.users, uid)
+		}
+	}
+}
+
+// upsertSource adds or updates users of the given source, other users of the source are kept.
+func (t *userTable) upsertSource(source string, users []User) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.upsertLocked(source, users)
+}
+
+func (t *userTable) upsertLocked(source string, users []User) {
+	for _, u := range users {
+		old, ok := t.users[u.UID]
+		if ok && old.Source != source {
+			continue
+		}
+		if ok {
+			u.UsedBytes = old.UsedBytes
+			u.Sessions = old.Sessions
+		}
+		u.Source = source
+		t.users[u.UID] = &u
+	}
+}
+
+// removeSource removes users of the given source, it returns how many were removed.
+func (t *userTable) removeSource(source string, uids []string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, uid := range uids {
+		if u, ok := t.users[uid]; ok && u.Source == source {
+			delete(t.users, uid)
+			n++
+		}
+	}
+	return n
+}
+
+func (t *userTable) addUsed(uid string, byteN int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.users[uid]; ok {
+		u.UsedBytes += byteN
+	}
+}
+
+// subUsed removes the bytes a report carried from a user of the given source,
+// the quota the manager returns already counts them.
+func (t *userTable) subUsed(source, uid string, byteN int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.users[uid]; ok && u.Source == source {
+		u.UsedBytes = max(u.UsedBytes-byteN, 0)
+	}
+}
+
+// acquireSession checks the user may open one more session and counts it,
+// the caller must call releaseSession once the session is over.
+func (t *userTable) acquireSession(uid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[uid]
+	if !ok || !u.Enabled || u.overQuota() {
+		return false
+	}
+	if u.MaxSessions > 0 && u.Sessions >= u.MaxSessions {
+		return false
+	}
+	u.Sessions++
+	return true
+}
+
+func (t *userTable) releaseSession(uid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u, ok := t.users[uid]; ok && u.Sessions > 0 {
+		u.Sessions--
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/unchainese/unchain/schema"
+)
+
+const (
+	webhookQueueSize   = 4096 //events waiting for a batch, more are dropped
+	webhookTargetQueue = 16   //batches waiting for a slow target, more are dropped
+	webhookAttempts    = 5
+	authFailWindow     = time.Minute
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookDelivery is an encoded batch, the ID is sent as the delivery header on every attempt.
+type webhookDelivery struct {
+	id   string
+	body []byte
+}
+
+type authFailures struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+// webhooks queues node events for the webhook targets. Emitting never blocks,
+// the relay goroutines hand the event over and the delivery happens in loopWebhooks.
+type webhooks struct {
+	events  chan schema.WebhookEvent
+	dropped atomic.Int64
+
+	mu        sync.Mutex
+	overQuota map[string]bool //users an over quota event was sent for
+	authFails map[string]*authFailures
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{
+		events:    make(chan schema.WebhookEvent, webhookQueueSize),
+		overQuota: make(map[string]bool),
+		authFails: make(map[string]*authFailures),
+	}
+}
+
+// emitEvent queues the event, it is dropped when no webhook is configured or the queue is full.
+func (app *App) emitEvent(ev schema.WebhookEvent) {
+	if app.conf().WebhookUrls == "" {
+		return
+	}
+	ev.ID = uuid.NewString()
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	select {
+	case app.webhooks.events <- ev:
+	default:
+		app.webhooks.dropped.Add(1)
+	}
+}
+
+// checkOverQuota sends user.over_quota once when the user crosses its quota,
+// again only after the usage was reset below the quota.
+func (app *App) checkOverQuota(uid string) {
+	u, ok := app.users.get(uid)
+	over := ok && u.overQuota()
+	w := app.webhooks
+	w.mu.Lock()
+	was := w.overQuota[uid]
+	if over {
+		w.overQuota[uid] = true
+	} else {
+		delete(w.overQuota, uid)
+	}
+	w.mu.Unlock()
+	if over && !was {
+		app.emitEvent(schema.WebhookEvent{Type: schema.WebhookUserOverQuota, UID: uid, QuotaKb: u.QuotaKb})
+	}
+}
+
+// authFailed counts an unknown UUID from the IP, auth.invalid_uuid is sent once per window
+// when the IP reaches AuthFailLimit.
+func (app *App) authFailed(ip string) {
+	now := time.Now()
+	w := app.webhooks
+	w.mu.Lock()
+	f, ok := w.authFails[ip]
+	if !ok || now.Sub(f.start) > authFailWindow {
+		f = &authFailures{start: now}
+		w.authFails[ip] = f
+	}
+	f.count++
+	report := !f.reported && f.count >= app.conf().AuthFailThreshold()
+	if report {
+		f.reported = true
+	}
+	count := f.count
+	w.mu.Unlock()
+	if report {
+		slog.Warn("repeated invalid uuid", "ip", ip, "failures", count)
+		app.emitEvent(schema.WebhookEvent{Type: schema.WebhookInvalidUUID, RemoteIP: ip, Failures: count})
+	}
+}
+
+func (w *webhooks) pruneAuthFailures(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ip, f := range w.authFails {
+		if now.Sub(f.start) > authFailWindow {
+			delete(w.authFails, ip)
+		}
+	}
+}
+
+// clientIP returns the client address. The reverse proxy headers are only read from a trusted proxy,
+// in X-Forwarded-For the last address not of a trusted proxy is the client.
+func (app *App) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies := app.acl.Load().proxies
+	trusted := func(s string) bool {
+		ip, err := netip.ParseAddr(strings.TrimSpace(s))
+		return err == nil && prefixesContain(proxies, ip.Unmap())
+	}
+	if !trusted(host) {
+		return host
+	}
+	for _, h := range []string{"CF-Connecting-IP", "X-Real-IP"} {
+		if v := strings.TrimSpace(r.Header.Get(h)); v != "" {
+			return v
+		}
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(hops[i]); hop != "" && !trusted(hop) {
+			return hop
+		}
+	}
+	return host
+}
+
+// loopWebhooks batches the events and hands the batches to one sender per target,
+// so a slow target delays neither the relay nor the other targets.
+func (app *App) loopWebhooks() {
+	hostname, _ := os.Hostname()
+	senders := make(map[string]chan webhookDelivery)
+	batch := make([]schema.WebhookEvent, 0)
+	flush := func() {
+		dropped := app.webhooks.dropped.Swap(0)
+		if len(batch) == 0 && dropped == 0 {
+			return
+		}
+		b := schema.WebhookBatch{ID: uuid.NewString(), Hostname: hostname, SentAt: time.Now(), Events: batch, Dropped: dropped}
+		batch = make([]schema.WebhookEvent, 0)
+		if dropped > 0 {
+			log.Println("webhook queue full, events dropped:", dropped)
+		}
+		body, err := json.Marshal(b)
+		if err != nil {
+			log.Println("Error encoding webhook batch:", err)
+			return
+		}
+		for _, url := range app.conf().WebhookTargets() {
+			ch, ok := senders[url]
+			if !ok {
+				ch = make(chan webhookDelivery, webhookTargetQueue)
+				senders[url] = ch
+				go app.sendWebhooks(url, ch)
+			}
+			select {
+			case ch <- webhookDelivery{id: b.ID, body: body}:
+			default:
+				log.Println("webhook target too slow, batch dropped:", url, len(b.Events))
+			}
+		}
+	}
+
+	tk := time.NewTicker(app.conf().WebhookFlushInterval())
+	defer tk.Stop()
+	for {
+		select {
+		case ev := <-app.webhooks.events:
+			batch = append(batch, ev)
+			if len(batch) >= app.conf().WebhookBatch() {
+				flush()
+			}
+		case now := <-tk.C:
+			flush()
+			app.webhooks.pruneAuthFailures(now)
+		}
+	}
+}
+
+// sendWebhooks delivers the batches to one target, each retried with backoff under the same delivery ID.
+func (app *App) sendWebhooks(url string, ch chan webhookDelivery) {
+	for d := range ch {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := app.postWebhook(url, d)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Println("Error delivering webhook, batch dropped:", url, err)
+				break
+			}
+			slog.Debug("webhook delivery failed, retrying", "url", url, "attempt", attempt, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (app *App) postWebhook(url string, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentTypeHeader, contentTypeJSON)
+	if secret := app.conf().WebhookSecret; secret != "" {
+		schema.SignWebhook(req.Header, secret, d.id, d.body)
+	} else {
+		req.Header.Set(schema.HeaderDelivery, d.id)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}